@@ -0,0 +1,74 @@
+// Package backoff computes the delays between the attempts of an operation.
+package backoff
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	// DefaultInitial is the delay before the second attempt if Initial is 0.
+	DefaultInitial = 10 * time.Millisecond
+	// DefaultMax is the max delay if Max is 0.
+	DefaultMax = time.Second
+	// DefaultMultiplier is the growth factor of the delays if Multiplier is 0.
+	DefaultMultiplier = 2
+)
+
+// Backoff is an exponential backoff with jitter. The zero value is usable and
+// uses the defaults above without jitter.
+type Backoff struct {
+	// Initial is the delay after the first attempt.
+	Initial time.Duration
+	// Max is the upper bound of the delays, before the jitter is applied.
+	Max time.Duration
+	// Multiplier is the growth factor of the delays.
+	Multiplier float64
+	// Jitter is the random fraction of the delay added or subtracted, which
+	// must be in [0, 1]. For example, a delay of 100ms with a jitter of 0.2 is
+	// randomized to [80ms, 120ms].
+	Jitter float64
+}
+
+// Delay returns the delay after the given attempt, which starts from 1.
+func (b Backoff) Delay(attempt int) time.Duration {
+	initial, max, multiplier := b.Initial, b.Max, b.Multiplier
+	if initial <= 0 {
+		initial = DefaultInitial
+	}
+	if max <= 0 {
+		max = DefaultMax
+	}
+	if multiplier <= 0 {
+		multiplier = DefaultMultiplier
+	}
+	delay := float64(initial) * math.Pow(multiplier, float64(attempt-1))
+	if delay > float64(max) {
+		delay = float64(max)
+	}
+	if b.Jitter > 0 {
+		delay += delay * b.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(delay)
+}
+
+// Wait sleeps for the delay after the given attempt. It returns the error of
+// the context if the context is done during the sleep, or returns
+// context.DeadlineExceeded immediately if the deadline of the context comes
+// before the end of the delay.
+func (b Backoff) Wait(ctx context.Context, attempt int) error {
+	delay := b.Delay(attempt)
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		return context.DeadlineExceeded
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
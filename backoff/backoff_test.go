@@ -0,0 +1,36 @@
+package backoff
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackoff_Delay(t *testing.T) {
+	b := Backoff{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond}
+	expected := []time.Duration{10, 20, 40, 50, 50}
+	for i, e := range expected {
+		if delay := b.Delay(i + 1); delay != e*time.Millisecond {
+			t.Errorf("attempt %d: expected %v, got %v", i+1, e*time.Millisecond, delay)
+		}
+	}
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if delay := b.Delay(1); delay < 5*time.Millisecond || delay > 15*time.Millisecond {
+			t.Fatalf("expected a delay in [5ms, 15ms], got %v", delay)
+		}
+	}
+}
+
+func TestBackoff_Wait(t *testing.T) {
+	b := Backoff{Initial: time.Second}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := b.Wait(ctx, 1); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("expected to return immediately, but waited %v", elapsed)
+	}
+}
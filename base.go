@@ -3,13 +3,17 @@ package sql
 import (
 	"context"
 	"database/sql"
+	"strings"
 )
 
 var (
-	_ DB   = (*BaseDB)(nil)
-	_ Stmt = (*BaseStmt)(nil)
-	_ Tx   = (*BaseTx)(nil)
-	_ Conn = (*BaseConn)(nil)
+	_ DB            = (*BaseDB)(nil)
+	_ Stmt          = (*BaseStmt)(nil)
+	_ QueryStringer = (*BaseStmt)(nil)
+	_ Tx            = (*BaseTx)(nil)
+	_ Conn          = (*BaseConn)(nil)
+	_ Rows          = (*BaseRows)(nil)
+	_ Row           = (*BaseRow)(nil)
 )
 
 // BaseDB is the most inner middleware, which implements the DB interface. Other
@@ -20,12 +24,38 @@ type BaseDB struct {
 
 func (b *BaseDB) PrepareContext(ctx context.Context, query string) (Stmt, error) {
 	stmt, err := b.DB.PrepareContext(ctx, query)
-	return &BaseStmt{stmt}, err
+	return &BaseStmt{stmt, query}, err
 }
 
 func (b *BaseDB) Prepare(query string) (Stmt, error) {
 	stmt, err := b.DB.Prepare(query)
-	return &BaseStmt{stmt}, err
+	return &BaseStmt{stmt, query}, err
+}
+
+func (b *BaseDB) ExecContext(ctx context.Context, query string, args ...interface{}) (Result, error) {
+	return b.DB.ExecContext(ctx, query, args...)
+}
+
+func (b *BaseDB) Exec(query string, args ...interface{}) (Result, error) {
+	return b.DB.Exec(query, args...)
+}
+
+func (b *BaseDB) QueryContext(ctx context.Context, query string, args ...interface{}) (Rows, error) {
+	rows, err := b.DB.QueryContext(ctx, query, args...)
+	return &BaseRows{rows}, err
+}
+
+func (b *BaseDB) Query(query string, args ...interface{}) (Rows, error) {
+	rows, err := b.DB.Query(query, args...)
+	return &BaseRows{rows}, err
+}
+
+func (b *BaseDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) Row {
+	return &BaseRow{b.DB.QueryRowContext(ctx, query, args...)}
+}
+
+func (b *BaseDB) QueryRow(query string, args ...interface{}) Row {
+	return &BaseRow{b.DB.QueryRow(query, args...)}
 }
 
 func (b *BaseDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (Tx, error) {
@@ -46,9 +76,41 @@ func (b *BaseDB) OriginDB() *sql.DB {
 	return b.DB
 }
 
-// BaseStmt implements the Stmt interface.
+// BaseStmt implements the Stmt interface. It remembers the text of the
+// prepared query.
 type BaseStmt struct {
 	*sql.Stmt
+	query string
+}
+
+func (b *BaseStmt) ExecContext(ctx context.Context, args ...interface{}) (Result, error) {
+	return b.Stmt.ExecContext(ctx, args...)
+}
+
+func (b *BaseStmt) Exec(args ...interface{}) (Result, error) {
+	return b.Stmt.Exec(args...)
+}
+
+func (b *BaseStmt) QueryContext(ctx context.Context, args ...interface{}) (Rows, error) {
+	rows, err := b.Stmt.QueryContext(ctx, args...)
+	return &BaseRows{rows}, err
+}
+
+func (b *BaseStmt) Query(args ...interface{}) (Rows, error) {
+	rows, err := b.Stmt.Query(args...)
+	return &BaseRows{rows}, err
+}
+
+func (b *BaseStmt) QueryRowContext(ctx context.Context, args ...interface{}) Row {
+	return &BaseRow{b.Stmt.QueryRowContext(ctx, args...)}
+}
+
+func (b *BaseStmt) QueryRow(args ...interface{}) Row {
+	return &BaseRow{b.Stmt.QueryRow(args...)}
+}
+
+func (b *BaseStmt) QueryString() string {
+	return b.query
 }
 
 func (b *BaseStmt) OriginStmt() *sql.Stmt {
@@ -62,17 +124,43 @@ type BaseTx struct {
 
 func (b *BaseTx) PrepareContext(ctx context.Context, query string) (Stmt, error) {
 	stmt, err := b.Tx.PrepareContext(ctx, query)
-	return &BaseStmt{stmt}, err
+	return &BaseStmt{stmt, query}, err
 }
 func (b *BaseTx) Prepare(query string) (Stmt, error) {
 	stmt, err := b.Tx.Prepare(query)
-	return &BaseStmt{stmt}, err
+	return &BaseStmt{stmt, query}, err
 }
 func (b *BaseTx) StmtContext(ctx context.Context, stmt Stmt) Stmt {
-	return &BaseStmt{b.Tx.StmtContext(ctx, stmt.OriginStmt())}
+	return &BaseStmt{b.Tx.StmtContext(ctx, stmt.OriginStmt()), QueryString(stmt)}
 }
 func (b *BaseTx) Stmt(stmt Stmt) Stmt {
-	return &BaseStmt{b.Tx.Stmt(stmt.OriginStmt())}
+	return &BaseStmt{b.Tx.Stmt(stmt.OriginStmt()), QueryString(stmt)}
+}
+
+func (b *BaseTx) ExecContext(ctx context.Context, query string, args ...interface{}) (Result, error) {
+	return b.Tx.ExecContext(ctx, query, args...)
+}
+
+func (b *BaseTx) Exec(query string, args ...interface{}) (Result, error) {
+	return b.Tx.Exec(query, args...)
+}
+
+func (b *BaseTx) QueryContext(ctx context.Context, query string, args ...interface{}) (Rows, error) {
+	rows, err := b.Tx.QueryContext(ctx, query, args...)
+	return &BaseRows{rows}, err
+}
+
+func (b *BaseTx) Query(query string, args ...interface{}) (Rows, error) {
+	rows, err := b.Tx.Query(query, args...)
+	return &BaseRows{rows}, err
+}
+
+func (b *BaseTx) QueryRowContext(ctx context.Context, query string, args ...interface{}) Row {
+	return &BaseRow{b.Tx.QueryRowContext(ctx, query, args...)}
+}
+
+func (b *BaseTx) QueryRow(query string, args ...interface{}) Row {
+	return &BaseRow{b.Tx.QueryRow(query, args...)}
 }
 
 func (b *BaseTx) OriginTx() *sql.Tx {
@@ -84,9 +172,22 @@ type BaseConn struct {
 	*sql.Conn
 }
 
+func (b *BaseConn) ExecContext(ctx context.Context, query string, args ...interface{}) (Result, error) {
+	return b.Conn.ExecContext(ctx, query, args...)
+}
+
+func (b *BaseConn) QueryContext(ctx context.Context, query string, args ...interface{}) (Rows, error) {
+	rows, err := b.Conn.QueryContext(ctx, query, args...)
+	return &BaseRows{rows}, err
+}
+
+func (b *BaseConn) QueryRowContext(ctx context.Context, query string, args ...interface{}) Row {
+	return &BaseRow{b.Conn.QueryRowContext(ctx, query, args...)}
+}
+
 func (b *BaseConn) PrepareContext(ctx context.Context, query string) (Stmt, error) {
 	stmt, err := b.Conn.PrepareContext(ctx, query)
-	return &BaseStmt{stmt}, err
+	return &BaseStmt{stmt, query}, err
 }
 func (b *BaseConn) BeginTx(ctx context.Context, opts *sql.TxOptions) (Tx, error) {
 	tx, err := b.Conn.BeginTx(ctx, opts)
@@ -95,3 +196,26 @@ func (b *BaseConn) BeginTx(ctx context.Context, opts *sql.TxOptions) (Tx, error)
 func (b *BaseConn) OriginConn() *sql.Conn {
 	return b.Conn
 }
+
+// BaseRows implements the Rows interface.
+type BaseRows struct {
+	*sql.Rows
+}
+
+func (b *BaseRows) OriginRows() *sql.Rows {
+	return b.Rows
+}
+
+// BaseRow implements the Row interface.
+type BaseRow struct {
+	*sql.Row
+}
+
+func (b *BaseRow) OriginRow() *sql.Row {
+	return b.Row
+}
+
+// quoteIdentifier quotes the identifier with backticks.
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
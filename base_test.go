@@ -0,0 +1,231 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+var (
+	errBaseQuery = errors.New("query failed")
+	errBaseNext  = errors.New("next failed")
+)
+
+// baseDriver is a driver whose queries return the rows 1 and 2, except that
+// the query FAIL fails and the query BROKEN fails after the first row.
+type baseDriver struct{}
+
+func (baseDriver) Open(string) (driver.Conn, error) {
+	return baseConn{}, nil
+}
+
+type baseConn struct{}
+
+func (baseConn) Prepare(query string) (driver.Stmt, error) {
+	return baseStmt{query}, nil
+}
+
+func (baseConn) Close() error {
+	return nil
+}
+
+func (baseConn) Begin() (driver.Tx, error) {
+	return baseTx{}, nil
+}
+
+type baseTx struct{}
+
+func (baseTx) Commit() error {
+	return nil
+}
+
+func (baseTx) Rollback() error {
+	return nil
+}
+
+type baseStmt struct {
+	query string
+}
+
+func (baseStmt) Close() error {
+	return nil
+}
+
+func (baseStmt) NumInput() int {
+	return -1
+}
+
+func (s baseStmt) Exec([]driver.Value) (driver.Result, error) {
+	if s.query == "FAIL" {
+		return nil, errBaseQuery
+	}
+	return baseResult{}, nil
+}
+
+func (s baseStmt) Query([]driver.Value) (driver.Rows, error) {
+	if s.query == "FAIL" {
+		return nil, errBaseQuery
+	}
+	return &baseRows{broken: s.query == "BROKEN"}, nil
+}
+
+type baseResult struct{}
+
+func (baseResult) LastInsertId() (int64, error) {
+	return 7, nil
+}
+
+func (baseResult) RowsAffected() (int64, error) {
+	return 3, nil
+}
+
+type baseRows struct {
+	next   int64
+	broken bool
+}
+
+func (r *baseRows) Columns() []string {
+	return []string{"n"}
+}
+
+func (r *baseRows) ColumnTypeDatabaseTypeName(int) string {
+	return "BIGINT"
+}
+
+func (r *baseRows) Close() error {
+	return nil
+}
+
+func (r *baseRows) Next(dest []driver.Value) error {
+	if r.broken && r.next == 1 {
+		return errBaseNext
+	}
+	if r.next == 2 {
+		return io.EOF
+	}
+	r.next++
+	dest[0] = r.next
+	return nil
+}
+
+func init() {
+	sql.Register("base", baseDriver{})
+}
+
+func openBase(t *testing.T) DB {
+	db, err := sql.Open("base", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	return &BaseDB{DB: db}
+}
+
+func TestBaseRows(t *testing.T) {
+	db := openBase(t)
+	rows, err := db.QueryContext(context.Background(), "SELECT n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows.OriginRows() == nil {
+		t.Fatal("expected the origin rows")
+	}
+	columns, err := rows.Columns()
+	if err != nil || !reflect.DeepEqual(columns, []string{"n"}) {
+		t.Fatalf("expected the column n, got %v and %v", columns, err)
+	}
+	types, err := rows.ColumnTypes()
+	if err != nil || len(types) != 1 || types[0].DatabaseTypeName() != "BIGINT" {
+		t.Fatalf("expected a BIGINT column, got %v and %v", types, err)
+	}
+	var values []int64
+	for rows.Next() {
+		var n int64
+		if err := rows.Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, n)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, []int64{1, 2}) {
+		t.Fatalf("expected 1 and 2, got %v", values)
+	}
+	if rows.NextResultSet() {
+		t.Fatal("expected no more result sets")
+	}
+	if err := rows.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var n int64
+	if err := rows.Scan(&n); err == nil {
+		t.Fatal("expected an error scanning the closed rows")
+	}
+}
+
+func TestBaseRows_Err(t *testing.T) {
+	db := openBase(t)
+	if _, err := db.Query("FAIL"); err != errBaseQuery {
+		t.Fatalf("expected %v, got %v", errBaseQuery, err)
+	}
+	rows, err := db.Query("BROKEN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(rows Rows) {
+		_ = rows.Close()
+	}(rows)
+	count := 0
+	for rows.Next() {
+		count++
+	}
+	if count != 1 || rows.Err() != errBaseNext {
+		t.Fatalf("expected 1 row and %v, got %d and %v", errBaseNext, count, rows.Err())
+	}
+}
+
+func TestBaseRow(t *testing.T) {
+	db := openBase(t)
+	row := db.QueryRowContext(context.Background(), "SELECT n")
+	if row.OriginRow() == nil {
+		t.Fatal("expected the origin row")
+	}
+	if err := row.Err(); err != nil {
+		t.Fatal(err)
+	}
+	var n int64
+	if err := row.Scan(&n); err != nil || n != 1 {
+		t.Fatalf("expected 1, got %d and %v", n, err)
+	}
+	row = db.QueryRow("FAIL")
+	if err := row.Err(); err != errBaseQuery {
+		t.Fatalf("expected %v, got %v", errBaseQuery, err)
+	}
+	if err := row.Scan(&n); err != errBaseQuery {
+		t.Fatalf("expected %v, got %v", errBaseQuery, err)
+	}
+}
+
+func TestBaseResult(t *testing.T) {
+	db := openBase(t)
+	result, err := db.Exec("UPDATE t SET n = 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := result.LastInsertId(); err != nil || id != 7 {
+		t.Fatalf("expected the last insert id 7, got %d and %v", id, err)
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected != 3 {
+		t.Fatalf("expected 3 affected rows, got %d and %v", affected, err)
+	}
+	if _, err := db.Exec("FAIL"); err != errBaseQuery {
+		t.Fatalf("expected %v, got %v", errBaseQuery, err)
+	}
+}
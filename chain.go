@@ -0,0 +1,30 @@
+package sql
+
+import (
+	"database/sql"
+)
+
+// Middleware wraps a DB and returns a new DB, which usually delegates to the
+// wrapped one after (or before) doing its own job.
+type Middleware func(DB) DB
+
+// Chain wraps the base DB with the middlewares. The first middleware is the
+// outermost one, so Chain(base, a, b) is equivalent to a(b(base)), and a call
+// on the returned DB flows through a, then b, then reaches base.
+func Chain(base DB, mws ...Middleware) DB {
+	for i := len(mws) - 1; i >= 0; i-- {
+		base = mws[i](base)
+	}
+	return base
+}
+
+// Open opens a database specified by its database driver name and a
+// driver-specific data source name, wraps it with BaseDB and then with the
+// middlewares in the same order as Chain.
+func Open(driverName, dsn string, mws ...Middleware) (DB, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return Chain(&BaseDB{DB: db}, mws...), nil
+}
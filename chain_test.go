@@ -0,0 +1,38 @@
+package sql
+
+import (
+	"testing"
+)
+
+type nameDB struct {
+	DB
+	name string
+}
+
+func (n *nameDB) Unwrap() DB {
+	return n.DB
+}
+
+func named(name string) Middleware {
+	return func(db DB) DB {
+		return &nameDB{DB: db, name: name}
+	}
+}
+
+func TestChain(t *testing.T) {
+	base := &BaseDB{}
+	db := Chain(base, named("a"), named("b"), named("c"))
+	for _, name := range []string{"a", "b", "c"} {
+		n, ok := db.(*nameDB)
+		if !ok {
+			t.Fatalf("expected middleware %s, got %T", name, db)
+		}
+		if n.name != name {
+			t.Fatalf("expected middleware %s, got %s", name, n.name)
+		}
+		db = n.DB
+	}
+	if db != base {
+		t.Fatalf("expected the base DB, got %T", db)
+	}
+}
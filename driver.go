@@ -0,0 +1,407 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+)
+
+// DriverConn is the driver-level counterpart of the Conn interface. It merges
+// the optional interfaces of driver.Conn into a single one, so a driver-level
+// middleware can intercept every call without type assertions.
+type DriverConn interface {
+	PrepareContext(ctx context.Context, query string) (DriverStmt, error)
+	// ExecContext may return driver.ErrSkip, then the database/sql package
+	// will prepare the query and execute the statement instead.
+	ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error)
+	// QueryContext may return driver.ErrSkip, then the database/sql package
+	// will prepare the query and query the statement instead.
+	QueryContext(ctx context.Context, query string, args []driver.NamedValue) (DriverRows, error)
+	BeginTx(ctx context.Context, opts driver.TxOptions) (DriverTx, error)
+	Ping(ctx context.Context) error
+	ResetSession(ctx context.Context) error
+	IsValid() bool
+	// CheckNamedValue may return driver.ErrSkip to use the default conversion.
+	CheckNamedValue(nv *driver.NamedValue) error
+	Close() error
+	OriginConn() driver.Conn
+}
+
+// DriverStmt is the driver-level counterpart of the Stmt interface.
+type DriverStmt interface {
+	ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error)
+	QueryContext(ctx context.Context, args []driver.NamedValue) (DriverRows, error)
+	NumInput() int
+	// CheckNamedValue may return driver.ErrSkip to let the connection check
+	// the value.
+	CheckNamedValue(nv *driver.NamedValue) error
+	Close() error
+	OriginStmt() driver.Stmt
+}
+
+// DriverTx is the driver-level counterpart of the Tx interface.
+type DriverTx interface {
+	Commit() error
+	Rollback() error
+	OriginTx() driver.Tx
+}
+
+// DriverRows is the driver-level counterpart of the Rows interface.
+type DriverRows interface {
+	Columns() []string
+	Next(dest []driver.Value) error
+	HasNextResultSet() bool
+	NextResultSet() error
+	Close() error
+	OriginRows() driver.Rows
+}
+
+// DriverMiddleware wraps a DriverConn and returns a new DriverConn, which is
+// the driver-level counterpart of Middleware.
+type DriverMiddleware func(DriverConn) DriverConn
+
+// DriverChain wraps the base DriverConn with the middlewares in the same order
+// as Chain, i.e. the first middleware is the outermost one.
+func DriverChain(base DriverConn, mws ...DriverMiddleware) DriverConn {
+	for i := len(mws) - 1; i >= 0; i-- {
+		base = mws[i](base)
+	}
+	return base
+}
+
+// WrapDriver returns a driver whose connections are wrapped with the
+// middlewares. The middlewares can see every call made by a plain *sql.DB,
+// so they work with the code which knows nothing about the DB interface.
+func WrapDriver(d driver.Driver, mws ...DriverMiddleware) driver.Driver {
+	return &wrappedDriver{d, mws}
+}
+
+// WrapConnector returns a connector whose connections are wrapped with the
+// middlewares.
+func WrapConnector(c driver.Connector, mws ...DriverMiddleware) driver.Connector {
+	return &wrappedConnector{c, mws}
+}
+
+// OpenConnector looks up the driver registered with the driver name, and
+// returns a connector for the data source name whose connections are wrapped
+// with the middlewares.
+func OpenConnector(driverName, dsn string, mws ...DriverMiddleware) (driver.Connector, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	d := db.Driver()
+	if err := db.Close(); err != nil {
+		return nil, err
+	}
+	return WrapDriver(d, mws...).(driver.DriverContext).OpenConnector(dsn)
+}
+
+// OpenDB opens a database using the connector, wraps it with BaseDB and then
+// with the middlewares in the same order as Chain.
+func OpenDB(c driver.Connector, mws ...Middleware) DB {
+	return Chain(&BaseDB{DB: sql.OpenDB(c)}, mws...)
+}
+
+type wrappedDriver struct {
+	driver.Driver
+	mws []DriverMiddleware
+}
+
+func (w *wrappedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := w.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return wrapDriverConn(conn, w.mws), nil
+}
+
+func (w *wrappedDriver) OpenConnector(name string) (driver.Connector, error) {
+	if d, ok := w.Driver.(driver.DriverContext); ok {
+		c, err := d.OpenConnector(name)
+		if err != nil {
+			return nil, err
+		}
+		return &wrappedConnector{c, w.mws}, nil
+	}
+	return &dsnConnector{name, w}, nil
+}
+
+type wrappedConnector struct {
+	driver.Connector
+	mws []DriverMiddleware
+}
+
+func (w *wrappedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := w.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return wrapDriverConn(conn, w.mws), nil
+}
+
+func (w *wrappedConnector) Driver() driver.Driver {
+	return &wrappedDriver{w.Connector.Driver(), w.mws}
+}
+
+// Close closes the inner connector if it is an io.Closer, which is called by
+// sql.DB.Close.
+func (w *wrappedConnector) Close() error {
+	if c, ok := w.Connector.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// dsnConnector is the connector of the drivers which don't implement the
+// driver.DriverContext interface.
+type dsnConnector struct {
+	dsn string
+	d   driver.Driver
+}
+
+func (d *dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return d.d.Open(d.dsn)
+}
+
+func (d *dsnConnector) Driver() driver.Driver {
+	return d.d
+}
+
+func wrapDriverConn(conn driver.Conn, mws []DriverMiddleware) driver.Conn {
+	return &driverConn{DriverChain(&BaseDriverConn{conn}, mws...)}
+}
+
+// BaseDriverConn is the most inner driver-level middleware, which implements
+// the DriverConn interface with the optional interfaces of the driver.Conn, and
+// falls back to the behaviors of the database/sql package if the driver.Conn
+// doesn't implement them.
+type BaseDriverConn struct {
+	driver.Conn
+}
+
+func (b *BaseDriverConn) PrepareContext(ctx context.Context, query string) (DriverStmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if c, ok := b.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = c.PrepareContext(ctx, query)
+	} else {
+		stmt, err = b.Conn.Prepare(query)
+		if err == nil && ctx.Err() != nil {
+			_ = stmt.Close()
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &BaseDriverStmt{stmt}, nil
+}
+
+func (b *BaseDriverConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if c, ok := b.Conn.(driver.ExecerContext); ok {
+		return c.ExecContext(ctx, query, args)
+	}
+	if c, ok := b.Conn.(driver.Execer); ok {
+		values, err := namedValuesToValues(args)
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return c.Exec(query, values)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (b *BaseDriverConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (DriverRows, error) {
+	var rows driver.Rows
+	var err error
+	if c, ok := b.Conn.(driver.QueryerContext); ok {
+		rows, err = c.QueryContext(ctx, query, args)
+	} else if c, ok := b.Conn.(driver.Queryer); ok {
+		var values []driver.Value
+		if values, err = namedValuesToValues(args); err == nil {
+			if err = ctx.Err(); err == nil {
+				rows, err = c.Query(query, values)
+			}
+		}
+	} else {
+		err = driver.ErrSkip
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &BaseDriverRows{rows}, nil
+}
+
+func (b *BaseDriverConn) BeginTx(ctx context.Context, opts driver.TxOptions) (DriverTx, error) {
+	var tx driver.Tx
+	var err error
+	if c, ok := b.Conn.(driver.ConnBeginTx); ok {
+		tx, err = c.BeginTx(ctx, opts)
+	} else if opts.Isolation != driver.IsolationLevel(sql.LevelDefault) {
+		err = errors.New("sql: driver does not support non-default isolation level")
+	} else if opts.ReadOnly {
+		err = errors.New("sql: driver does not support read-only transactions")
+	} else if err = ctx.Err(); err == nil {
+		tx, err = b.Conn.Begin()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &BaseDriverTx{tx}, nil
+}
+
+func (b *BaseDriverConn) Ping(ctx context.Context) error {
+	if c, ok := b.Conn.(driver.Pinger); ok {
+		return c.Ping(ctx)
+	}
+	return nil
+}
+
+func (b *BaseDriverConn) ResetSession(ctx context.Context) error {
+	if c, ok := b.Conn.(driver.SessionResetter); ok {
+		return c.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (b *BaseDriverConn) IsValid() bool {
+	if c, ok := b.Conn.(driver.Validator); ok {
+		return c.IsValid()
+	}
+	return true
+}
+
+func (b *BaseDriverConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if c, ok := b.Conn.(driver.NamedValueChecker); ok {
+		return c.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (b *BaseDriverConn) OriginConn() driver.Conn {
+	return b.Conn
+}
+
+// BaseDriverStmt implements the DriverStmt interface.
+type BaseDriverStmt struct {
+	driver.Stmt
+}
+
+func (b *BaseDriverStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if s, ok := b.Stmt.(driver.StmtExecContext); ok {
+		return s.ExecContext(ctx, args)
+	}
+	values, err := namedValuesToValues(args)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return b.Stmt.Exec(values)
+}
+
+func (b *BaseDriverStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (DriverRows, error) {
+	var rows driver.Rows
+	var err error
+	if s, ok := b.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = s.QueryContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValuesToValues(args); err == nil {
+			if err = ctx.Err(); err == nil {
+				rows, err = b.Stmt.Query(values)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &BaseDriverRows{rows}, nil
+}
+
+// CheckNamedValue uses the driver.NamedValueChecker or the deprecated
+// driver.ColumnConverter of the statement, in the same way as the database/sql
+// package.
+func (b *BaseDriverStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if s, ok := b.Stmt.(driver.NamedValueChecker); ok {
+		return s.CheckNamedValue(nv)
+	}
+	s, ok := b.Stmt.(driver.ColumnConverter)
+	if !ok {
+		return driver.ErrSkip
+	}
+	index := nv.Ordinal - 1
+	if want := b.Stmt.NumInput(); want >= 0 && want <= index {
+		return nil
+	}
+	if vr, ok := nv.Value.(driver.Valuer); ok {
+		v, err := vr.Value()
+		if err != nil {
+			return err
+		}
+		nv.Value = v
+	}
+	v, err := s.ColumnConverter(index).ConvertValue(nv.Value)
+	if err != nil {
+		return err
+	}
+	if !driver.IsValue(v) {
+		return errors.New("sql: driver ColumnConverter converted a value to an unsupported type")
+	}
+	nv.Value = v
+	return nil
+}
+
+func (b *BaseDriverStmt) OriginStmt() driver.Stmt {
+	return b.Stmt
+}
+
+// BaseDriverTx implements the DriverTx interface.
+type BaseDriverTx struct {
+	driver.Tx
+}
+
+func (b *BaseDriverTx) OriginTx() driver.Tx {
+	return b.Tx
+}
+
+// BaseDriverRows implements the DriverRows interface.
+type BaseDriverRows struct {
+	driver.Rows
+}
+
+func (b *BaseDriverRows) HasNextResultSet() bool {
+	if r, ok := b.Rows.(driver.RowsNextResultSet); ok {
+		return r.HasNextResultSet()
+	}
+	return false
+}
+
+func (b *BaseDriverRows) NextResultSet() error {
+	if r, ok := b.Rows.(driver.RowsNextResultSet); ok {
+		return r.NextResultSet()
+	}
+	return io.EOF
+}
+
+func (b *BaseDriverRows) OriginRows() driver.Rows {
+	return b.Rows
+}
+
+func namedValuesToValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if len(arg.Name) > 0 {
+			return nil, errors.New("sql: driver does not support the use of Named Parameters")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
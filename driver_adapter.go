@@ -0,0 +1,223 @@
+package sql
+
+import (
+	"context"
+	"database/sql/driver"
+	"reflect"
+)
+
+// The adapters below expose the DriverConn and the objects created by it to the
+// database/sql package as the driver types with all the optional interfaces.
+
+var (
+	_ driver.Conn               = (*driverConn)(nil)
+	_ driver.ConnPrepareContext = (*driverConn)(nil)
+	_ driver.ExecerContext      = (*driverConn)(nil)
+	_ driver.QueryerContext     = (*driverConn)(nil)
+	_ driver.ConnBeginTx        = (*driverConn)(nil)
+	_ driver.Pinger             = (*driverConn)(nil)
+	_ driver.SessionResetter    = (*driverConn)(nil)
+	_ driver.Validator          = (*driverConn)(nil)
+	_ driver.NamedValueChecker  = (*driverConn)(nil)
+
+	_ driver.Stmt              = (*driverStmt)(nil)
+	_ driver.StmtExecContext   = (*driverStmt)(nil)
+	_ driver.StmtQueryContext  = (*driverStmt)(nil)
+	_ driver.NamedValueChecker = (*driverStmt)(nil)
+
+	_ driver.Tx = (*driverTx)(nil)
+
+	_ driver.Rows                           = (*driverRows)(nil)
+	_ driver.RowsNextResultSet              = (*driverRows)(nil)
+	_ driver.RowsColumnTypeScanType         = (*driverRows)(nil)
+	_ driver.RowsColumnTypeDatabaseTypeName = (*driverRows)(nil)
+	_ driver.RowsColumnTypeLength           = (*driverRows)(nil)
+	_ driver.RowsColumnTypeNullable         = (*driverRows)(nil)
+	_ driver.RowsColumnTypePrecisionScale   = (*driverRows)(nil)
+)
+
+type driverConn struct {
+	conn DriverConn
+}
+
+func (c *driverConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *driverConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.conn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &driverStmt{stmt, c.conn}, nil
+}
+
+func (c *driverConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.conn.ExecContext(ctx, query, args)
+}
+
+func (c *driverConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := c.conn.QueryContext(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &driverRows{rows}, nil
+}
+
+func (c *driverConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *driverConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	tx, err := c.conn.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &driverTx{tx}, nil
+}
+
+func (c *driverConn) Ping(ctx context.Context) error {
+	return c.conn.Ping(ctx)
+}
+
+func (c *driverConn) ResetSession(ctx context.Context) error {
+	return c.conn.ResetSession(ctx)
+}
+
+func (c *driverConn) IsValid() bool {
+	return c.conn.IsValid()
+}
+
+func (c *driverConn) CheckNamedValue(nv *driver.NamedValue) error {
+	return c.conn.CheckNamedValue(nv)
+}
+
+func (c *driverConn) Close() error {
+	return c.conn.Close()
+}
+
+type driverStmt struct {
+	stmt DriverStmt
+	conn DriverConn
+}
+
+func (s *driverStmt) Close() error {
+	return s.stmt.Close()
+}
+
+func (s *driverStmt) NumInput() int {
+	return s.stmt.NumInput()
+}
+
+func (s *driverStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), valuesToNamedValues(args))
+}
+
+func (s *driverStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), valuesToNamedValues(args))
+}
+
+func (s *driverStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.stmt.ExecContext(ctx, args)
+}
+
+func (s *driverStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := s.stmt.QueryContext(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return &driverRows{rows}, nil
+}
+
+// CheckNamedValue falls back to the connection, because the database/sql
+// package only asks the connection if the statement is not a
+// driver.NamedValueChecker.
+func (s *driverStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if err := s.stmt.CheckNamedValue(nv); err != driver.ErrSkip {
+		return err
+	}
+	return s.conn.CheckNamedValue(nv)
+}
+
+type driverTx struct {
+	tx DriverTx
+}
+
+func (t *driverTx) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *driverTx) Rollback() error {
+	return t.tx.Rollback()
+}
+
+type driverRows struct {
+	rows DriverRows
+}
+
+func (r *driverRows) Columns() []string {
+	return r.rows.Columns()
+}
+
+func (r *driverRows) Close() error {
+	return r.rows.Close()
+}
+
+func (r *driverRows) Next(dest []driver.Value) error {
+	return r.rows.Next(dest)
+}
+
+func (r *driverRows) HasNextResultSet() bool {
+	return r.rows.HasNextResultSet()
+}
+
+func (r *driverRows) NextResultSet() error {
+	return r.rows.NextResultSet()
+}
+
+// The column type methods below read the metadata from the origin rows
+// directly, and return the same defaults as the database/sql package if the
+// origin rows don't support them.
+
+func (r *driverRows) ColumnTypeScanType(index int) reflect.Type {
+	if o, ok := r.rows.OriginRows().(driver.RowsColumnTypeScanType); ok {
+		return o.ColumnTypeScanType(index)
+	}
+	return reflect.TypeOf(new(interface{})).Elem()
+}
+
+func (r *driverRows) ColumnTypeDatabaseTypeName(index int) string {
+	if o, ok := r.rows.OriginRows().(driver.RowsColumnTypeDatabaseTypeName); ok {
+		return o.ColumnTypeDatabaseTypeName(index)
+	}
+	return ""
+}
+
+func (r *driverRows) ColumnTypeLength(index int) (length int64, ok bool) {
+	if o, ok := r.rows.OriginRows().(driver.RowsColumnTypeLength); ok {
+		return o.ColumnTypeLength(index)
+	}
+	return 0, false
+}
+
+func (r *driverRows) ColumnTypeNullable(index int) (nullable, ok bool) {
+	if o, ok := r.rows.OriginRows().(driver.RowsColumnTypeNullable); ok {
+		return o.ColumnTypeNullable(index)
+	}
+	return false, false
+}
+
+func (r *driverRows) ColumnTypePrecisionScale(index int) (precision, scale int64, ok bool) {
+	if o, ok := r.rows.OriginRows().(driver.RowsColumnTypePrecisionScale); ok {
+		return o.ColumnTypePrecisionScale(index)
+	}
+	return 0, 0, false
+}
+
+func valuesToNamedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return named
+}
@@ -0,0 +1,168 @@
+// Package fingerprint computes the fingerprints of the queries, which are the
+// shapes of the queries without the literals, to group the queries in the
+// metrics, logs and caches.
+package fingerprint
+
+import (
+	"github.com/developerdong/sql/sqlparse"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// Normalize returns the fingerprint of the query. The comments are stripped,
+// the literals are replaced by ?, the lists of the placeholders in IN and
+// VALUES are collapsed into (?+), the keywords and identifiers are lowercased
+// except the quoted ones, and the tokens are separated by single spaces.
+//
+//	SELECT * FROM t WHERE id IN (1, 2, 3) AND name = 'a' -- caller
+//
+// becomes
+//
+//	select * from t where id in(?+) and name = ?
+func Normalize(query string) string {
+	tokens := collapse(tokenize(query))
+	var b strings.Builder
+	b.Grow(len(query))
+	for i, token := range tokens {
+		if i > 0 && spaced(tokens[i-1], token) {
+			b.WriteByte(' ')
+		}
+		b.WriteString(token)
+	}
+	return b.String()
+}
+
+// Hash returns a short hash of the fingerprint of the query, which is 16
+// hexadecimal digits.
+func Hash(query string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(Normalize(query)))
+	s := strconv.FormatUint(h.Sum64(), 16)
+	return strings.Repeat("0", 16-len(s)) + s
+}
+
+// tokenize splits the query into the tokens of the fingerprint. The signs of
+// the literals are folded into the ?, so -1 and 1 have the same fingerprint.
+func tokenize(query string) []string {
+	tokens := make([]string, 0, len(query)/4)
+	// prev is the last token which is not a comment, and signs is the number
+	// of the unary signs at the end of the tokens.
+	var prev sqlparse.Token
+	signs := 0
+	t := sqlparse.NewTokenizer(query)
+	for token := t.Next(); token.Type != sqlparse.EOF; token = t.Next() {
+		switch token.Type {
+		case sqlparse.Comment:
+			continue
+		case sqlparse.String, sqlparse.Number, sqlparse.Placeholder:
+			tokens = append(tokens[:len(tokens)-signs], "?")
+			signs = 0
+		case sqlparse.Ident, sqlparse.Variable:
+			tokens = append(tokens, strings.ToLower(token.Text))
+			signs = 0
+		default:
+			if (token.IsSymbol("-") || token.IsSymbol("+")) && isOperator(prev) {
+				signs++
+			} else {
+				signs = 0
+			}
+			tokens = append(tokens, token.Text)
+		}
+		prev = token
+	}
+	return trim(tokens)
+}
+
+// operatorKeywords are the keywords which are followed by an operand, so a
+// sign after them is unary.
+var operatorKeywords = map[string]bool{
+	"SELECT": true, "WHERE": true, "AND": true, "OR": true, "XOR": true,
+	"NOT": true, "ON": true, "SET": true, "VALUES": true, "VALUE": true,
+	"HAVING": true, "BY": true, "LIMIT": true, "OFFSET": true, "CASE": true,
+	"WHEN": true, "THEN": true, "ELSE": true, "IN": true, "IS": true,
+	"LIKE": true, "BETWEEN": true, "REGEXP": true, "DIV": true, "MOD": true,
+	"INTERVAL": true, "RETURN": true,
+}
+
+// isOperator reports whether a sign after the token is unary, which is at the
+// beginning, or after an operator, an opening parenthesis, a comma or a
+// keyword expecting an operand.
+func isOperator(token sqlparse.Token) bool {
+	switch token.Type {
+	case sqlparse.EOF:
+		return true
+	case sqlparse.Symbol:
+		return token.Text != ")"
+	case sqlparse.Ident:
+		return operatorKeywords[strings.ToUpper(token.Text)]
+	}
+	return false
+}
+
+// trim removes the trailing semicolons.
+func trim(tokens []string) []string {
+	for len(tokens) > 0 && tokens[len(tokens)-1] == ";" {
+		tokens = tokens[:len(tokens)-1]
+	}
+	return tokens
+}
+
+// collapse collapses the lists of the placeholders after IN and VALUES, and
+// the multiple rows of VALUES.
+func collapse(tokens []string) []string {
+	out := make([]string, 0, len(tokens))
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i] == "(" && len(out) > 0 {
+			prev := out[len(out)-1]
+			if end := placeholders(tokens, i); end > 0 && (prev == "in" || prev == "values" || prev == "value") {
+				out = append(out, "(", "?+", ")")
+				i = end
+				for prev != "in" && i+1 < len(tokens) && tokens[i+1] == "," {
+					end = placeholders(tokens, i+2)
+					if end < 0 {
+						break
+					}
+					i = end
+				}
+				continue
+			}
+		}
+		out = append(out, tokens[i])
+	}
+	return out
+}
+
+// placeholders returns the index of the closing parenthesis if the tokens from
+// i are a parenthesized list of placeholders, or -1 otherwise.
+func placeholders(tokens []string, i int) int {
+	if i >= len(tokens) || tokens[i] != "(" {
+		return -1
+	}
+	for j := i + 1; j+1 < len(tokens); j += 2 {
+		if tokens[j] != "?" {
+			return -1
+		}
+		switch tokens[j+1] {
+		case ")":
+			return j + 1
+		case ",":
+		default:
+			return -1
+		}
+	}
+	return -1
+}
+
+// spaced reports whether there is a space between the tokens.
+func spaced(prev, next string) bool {
+	switch prev {
+	case "(", ".":
+		return false
+	}
+	switch next {
+	case "(", ")", ",", ".", ";":
+		return false
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package fingerprint
+
+import (
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	cases := []struct {
+		query       string
+		fingerprint string
+	}{
+		{"SELECT * FROM t WHERE id IN (1, 2, 3) AND name = 'a' -- caller", "select * from t where id in(?+) and name = ?"},
+		{"select *\n  from t\n where id in (?,?) and name='b';", "select * from t where id in(?+) and name = ?"},
+		{"INSERT INTO `T` (a, b) VALUES (1, 'x'), (2, 'y')", "insert into `T`(a, b) values(?+)"},
+		{"INSERT INTO t VALUES (?, ?) ON DUPLICATE KEY UPDATE a = VALUES(a)", "insert into t values(?+) on duplicate key update a = values(a)"},
+		{"SELECT /* hint */ t1.a FROM t1 WHERE b >= -1.5e-3 AND c <> 0x1F", "select t1.a from t1 where b >= ? and c <> ?"},
+		{"SELECT a FROM t WHERE a = -1 AND b = +2 OR c = - -?", "select a from t where a = ? and b = ? or c = ?"},
+		{"SELECT -1, a - 1, (a) - 1, f(-1), a - -1 FROM t LIMIT -1", "select ?, a - ?,(a) - ?, f(?), a - ? from t limit ?"},
+		{"SELECT a FROM t WHERE a IN (-1, 2, +3)", "select a from t where a in(?+)"},
+		{"INSERT INTO t VALUES (-1, -2.5e-3)", "insert into t values(?+)"},
+		{"SELECT \"it\\\"s\", 'it''s', X'0F', n'abc'", "select ?, ?, ?, ?"},
+		{"SELECT COUNT(*) FROM t # caller", "select count(*) from t"},
+		{"SELECT a FROM t WHERE a IN (SELECT b FROM u)", "select a from t where a in(select b from u)"},
+	}
+	for _, c := range cases {
+		if fingerprint := Normalize(c.query); fingerprint != c.fingerprint {
+			t.Errorf("%q: expected %q, got %q", c.query, c.fingerprint, fingerprint)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	hash := Hash("SELECT * FROM t WHERE id = 1")
+	if len(hash) != 16 {
+		t.Fatalf("expected 16 digits, got %q", hash)
+	}
+	if other := Hash("select *  from t where id = ?"); other != hash {
+		t.Fatalf("expected the same hash %q, got %q", hash, other)
+	}
+	if other := Hash("SELECT * FROM u WHERE id = 1"); other == hash {
+		t.Fatalf("expected different hashes, got %q", other)
+	}
+}
+
+func BenchmarkNormalize(b *testing.B) {
+	query := "SELECT id, name FROM users WHERE name = 'a' AND id IN (1, 2, 3) /* caller */"
+	for i := 0; i < b.N; i++ {
+		Normalize(query)
+	}
+}
@@ -18,12 +18,12 @@ type DB interface {
 	Stats() sql.DBStats
 	PrepareContext(ctx context.Context, query string) (Stmt, error)
 	Prepare(query string) (Stmt, error)
-	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
-	Exec(query string, args ...interface{}) (sql.Result, error)
-	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
-	Query(query string, args ...interface{}) (*sql.Rows, error)
-	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
-	QueryRow(query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (Result, error)
+	Exec(query string, args ...interface{}) (Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (Rows, error)
+	Query(query string, args ...interface{}) (Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) Row
+	QueryRow(query string, args ...interface{}) Row
 	BeginTx(ctx context.Context, opts *sql.TxOptions) (Tx, error)
 	Begin() (Tx, error)
 	Driver() driver.Driver
@@ -32,16 +32,34 @@ type DB interface {
 }
 
 type Stmt interface {
-	ExecContext(ctx context.Context, args ...interface{}) (sql.Result, error)
-	Exec(args ...interface{}) (sql.Result, error)
-	QueryContext(ctx context.Context, args ...interface{}) (*sql.Rows, error)
-	Query(args ...interface{}) (*sql.Rows, error)
-	QueryRowContext(ctx context.Context, args ...interface{}) *sql.Row
-	QueryRow(args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, args ...interface{}) (Result, error)
+	Exec(args ...interface{}) (Result, error)
+	QueryContext(ctx context.Context, args ...interface{}) (Rows, error)
+	Query(args ...interface{}) (Rows, error)
+	QueryRowContext(ctx context.Context, args ...interface{}) Row
+	QueryRow(args ...interface{}) Row
 	Close() error
 	OriginStmt() *sql.Stmt
 }
 
+// QueryStringer is the optional interface of the statements knowing the text
+// of their prepared query, such as BaseStmt. The method is not named Query
+// because of the Query method of Stmt.
+type QueryStringer interface {
+	QueryString() string
+}
+
+// QueryString returns the text of the prepared query of the statement, which
+// is got from the first QueryStringer in the stack of the statement found by
+// AsStmt. It returns "" if there is none.
+func QueryString(stmt Stmt) string {
+	var stringer QueryStringer
+	if AsStmt(stmt, &stringer) {
+		return stringer.QueryString()
+	}
+	return ""
+}
+
 type Tx interface {
 	Commit() error
 	Rollback() error
@@ -49,23 +67,45 @@ type Tx interface {
 	Prepare(query string) (Stmt, error)
 	StmtContext(ctx context.Context, stmt Stmt) Stmt
 	Stmt(stmt Stmt) Stmt
-	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
-	Exec(query string, args ...interface{}) (sql.Result, error)
-	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
-	Query(query string, args ...interface{}) (*sql.Rows, error)
-	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
-	QueryRow(query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (Result, error)
+	Exec(query string, args ...interface{}) (Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (Rows, error)
+	Query(query string, args ...interface{}) (Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) Row
+	QueryRow(query string, args ...interface{}) Row
 	OriginTx() *sql.Tx
 }
 
 type Conn interface {
 	PingContext(ctx context.Context) error
-	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
-	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
-	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) Row
 	PrepareContext(ctx context.Context, query string) (Stmt, error)
 	Raw(f func(driverConn interface{}) error) (err error)
 	BeginTx(ctx context.Context, opts *sql.TxOptions) (Tx, error)
 	Close() error
 	OriginConn() *sql.Conn
 }
+
+type Result interface {
+	LastInsertId() (int64, error)
+	RowsAffected() (int64, error)
+}
+
+type Rows interface {
+	Next() bool
+	NextResultSet() bool
+	Err() error
+	Columns() ([]string, error)
+	ColumnTypes() ([]*sql.ColumnType, error)
+	Scan(dest ...interface{}) error
+	Close() error
+	OriginRows() *sql.Rows
+}
+
+type Row interface {
+	Scan(dest ...interface{}) error
+	Err() error
+	OriginRow() *sql.Row
+}
@@ -1,135 +1,501 @@
 package middleware
 
 import (
+	"container/list"
 	"context"
 	stdSql "database/sql"
+	"errors"
 	"github.com/developerdong/sql"
+	"github.com/developerdong/sql/mysqlerr"
+	"golang.org/x/sync/singleflight"
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
 	_ sql.DB = (*CacheDB)(nil)
 )
 
+// CacheStats is the statistics of a CacheDB.
+type CacheStats struct {
+	// Hits is the number of the queries executed with a cached statement.
+	Hits int64
+	// Misses is the number of the queries not found in the cache.
+	Misses int64
+	// Evictions is the number of the statements evicted because the cache is
+	// full or they are idle for too long.
+	Evictions int64
+	// PrepareFailures is the number of the queries failed to be prepared.
+	PrepareFailures int64
+	// Size is the number of the cached statements.
+	Size int
+}
+
+// cacheShards is the number of the shards of a CacheDB.
+const cacheShards = 16
+
+// CacheDB caches the prepared statements of the queries, and executes the
+// queries with the cached statements.
+//
+// The cache is split into shards by the hash of the queries, and each shard has
+// its own lock and LRU list, so the hits only lock their own shard. The misses
+// evict the least recently used statements across all the shards, so the
+// MaxSize and the LRU order are global. The locks are never held during a
+// network call, and the concurrent misses of the same query share a single
+// prepare.
 type CacheDB struct {
 	sql.DB
-	mu    sync.RWMutex
-	stmts map[string]sql.Stmt
+	// MaxSize is the max number of the cached statements. The least recently
+	// used statement is evicted and closed if the cache is full. There is no
+	// limit if it is 0.
+	MaxSize int
+	// IdleTTL is the max time a statement is cached without being used. The
+	// idle statements are evicted when they are looked up, or at the next
+	// miss. There is no limit if it is 0.
+	IdleTTL time.Duration
+	// Normalizer normalizes the queries, so the same query written in
+	// different ways shares a statement. The normalized query is prepared, so
+	// it must not change the meaning of the query, and normalizing twice must
+	// be the same as once. NormalizeSpaces is used if it is nil, and
+	// StripComments can be used to ignore the comments too.
+	Normalizer func(query string) string
+
+	once     sync.Once
+	shards   []*cacheShard
+	prepares singleflight.Group
+	// evictMu serializes the evictions across the shards.
+	evictMu sync.Mutex
+}
+
+// cacheShard is a shard of the cache, whose fields are protected by the lock.
+type cacheShard struct {
+	mu    sync.Mutex
+	stmts map[string]*list.Element
+	lru   list.List
+	stats CacheStats
+}
+
+// cacheEntry is the value of the elements in the LRU list. The statement is
+// closed when the entry is evicted and no one is using it.
+type cacheEntry struct {
+	query    string
+	stmt     sql.Stmt
+	lastUsed time.Time
+	refs     int
+	evicted  bool
+}
+
+// NewCacheDB wraps the DB with a CacheDB. It fits the sql.Middleware type.
+func NewCacheDB(db sql.DB) sql.DB {
+	return &CacheDB{DB: db}
+}
+
+// Unwrap returns the wrapped DB.
+func (c *CacheDB) Unwrap() sql.DB {
+	return c.DB
+}
+
+// CacheStats returns the statistics of the cache.
+func (c *CacheDB) CacheStats() CacheStats {
+	var stats CacheStats
+	for _, sh := range c.getShards() {
+		sh.mu.Lock()
+		stats.Hits += sh.stats.Hits
+		stats.Misses += sh.stats.Misses
+		stats.Evictions += sh.stats.Evictions
+		stats.PrepareFailures += sh.stats.PrepareFailures
+		stats.Size += sh.lru.Len()
+		sh.mu.Unlock()
+	}
+	return stats
+}
+
+// getShards initializes the shards at the first use.
+func (c *CacheDB) getShards() []*cacheShard {
+	c.once.Do(func() {
+		c.shards = make([]*cacheShard, cacheShards)
+		for i := range c.shards {
+			c.shards[i] = &cacheShard{stmts: make(map[string]*list.Element)}
+		}
+	})
+	return c.shards
+}
+
+func (c *CacheDB) shard(query string) *cacheShard {
+	shards := c.getShards()
+	// FNV-1a
+	h := uint32(2166136261)
+	for i := 0; i < len(query); i++ {
+		h ^= uint32(query[i])
+		h *= 16777619
+	}
+	return shards[h%uint32(len(shards))]
 }
 
 func (c *CacheDB) normalize(query string) string {
-	query = strings.TrimSpace(query)
+	if c.Normalizer != nil {
+		query = c.Normalizer(query)
+	} else {
+		query = NormalizeSpaces(query)
+	}
 	if !strings.HasSuffix(query, ";") {
 		query += ";"
 	}
 	return query
 }
 
-func (c *CacheDB) getStmt(query string) (stmt sql.Stmt, err error) {
-	if c.stmts == nil {
-		c.mu.Lock()
-		if c.stmts == nil {
-			c.stmts = make(map[string]sql.Stmt)
+// errEvicted is returned by getStmt if the statement is evicted right after it
+// is prepared, which is rare, and the caller falls back to the inner DB.
+var errEvicted = errors.New("the statement is evicted")
+
+// getStmt returns the cached entry of the query, which must be released after
+// use. The statement is prepared with the context if it is not cached.
+func (c *CacheDB) getStmt(ctx context.Context, query string) (*cacheEntry, error) {
+	query = c.normalize(query)
+	sh := c.shard(query)
+	if e := sh.get(query, c.IdleTTL); e != nil {
+		return e, nil
+	}
+	ch := c.prepares.DoChan(query, func() (interface{}, error) {
+		stmt, err := c.DB.PrepareContext(ctx, query)
+		if err != nil {
+			sh.mu.Lock()
+			sh.stats.PrepareFailures++
+			sh.mu.Unlock()
+			return nil, err
+		}
+		now := time.Now()
+		e := sh.add(query, stmt)
+		c.shrink(now)
+		return e, nil
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
 		}
-		c.mu.Unlock()
+		e := res.Val.(*cacheEntry)
+		if !sh.acquire(e) {
+			return nil, errEvicted
+		}
+		return e, nil
 	}
+}
+
+// release releases the entry got from getStmt.
+func (c *CacheDB) release(e *cacheEntry) {
+	c.shard(e.query).release(e)
+}
+
+// rmStmt removes the entry from the cache, unless it has been replaced.
+func (c *CacheDB) rmStmt(e *cacheEntry) {
+	c.shard(e.query).remove(e)
+}
+
+// Flush removes all the statements from the cache, e.g. after a schema
+// migration. The statements are closed once no one is using them. The
+// statements being prepared during the flush may still be cached.
+func (c *CacheDB) Flush() {
+	for _, sh := range c.getShards() {
+		sh.clear()
+	}
+}
+
+// Evict removes the statement of the query from the cache, and reports whether
+// it was cached.
+func (c *CacheDB) Evict(query string) bool {
 	query = c.normalize(query)
-	c.mu.RLock()
-	stmt = c.stmts[query]
-	c.mu.RUnlock()
-	if stmt == nil {
-		c.mu.Lock()
-		stmt = c.stmts[query]
-		if stmt == nil {
-			stmt, err = c.Prepare(query)
-			if err == nil {
-				c.stmts[query] = stmt
+	sh := c.shard(query)
+	var closing []sql.Stmt
+	defer closeStmts(&closing)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	elem := sh.stmts[query]
+	if elem == nil {
+		return false
+	}
+	closing = sh.evict(elem, closing)
+	return true
+}
+
+// Warmup prepares and caches the statements of the queries, and returns the
+// errors of the failed ones by query, which is nil if all of them succeed. The
+// earlier queries may be evicted by the later ones if they exceed the MaxSize.
+func (c *CacheDB) Warmup(ctx context.Context, queries []string) map[string]error {
+	var failed map[string]error
+	for _, query := range queries {
+		e, err := c.getStmt(ctx, query)
+		if err != nil {
+			if failed == nil {
+				failed = make(map[string]error)
 			}
+			failed[query] = err
+			continue
 		}
-		c.mu.Unlock()
+		c.release(e)
 	}
-	return
+	return failed
+}
+
+// Close closes all the cached statements and the inner DB.
+func (c *CacheDB) Close() error {
+	c.Flush()
+	return c.DB.Close()
 }
 
-func (c *CacheDB) rmStmt(query string) {
-	if c.stmts == nil {
-		return
+// get returns the entry of the query, or nil if it is missing or idle for
+// longer than the TTL. The returned entry is acquired.
+func (sh *cacheShard) get(query string, ttl time.Duration) *cacheEntry {
+	now := time.Now()
+	var closing []sql.Stmt
+	defer closeStmts(&closing)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	closing = sh.evictIdle(now, ttl, closing)
+	elem := sh.stmts[query]
+	if elem == nil {
+		sh.stats.Misses++
+		return nil
 	}
-	query = c.normalize(query)
-	c.mu.Lock()
-	stmt := c.stmts[query]
-	delete(c.stmts, query)
-	c.mu.Unlock()
-	if stmt != nil {
+	sh.stats.Hits++
+	sh.lru.MoveToFront(elem)
+	e := elem.Value.(*cacheEntry)
+	e.lastUsed = now
+	e.refs++
+	return e
+}
+
+// shrink evicts the idle statements of all the shards, then the least recently
+// used statements across the shards until the size fits the MaxSize. The
+// oldest statement is found by comparing the backs of the LRU lists of the
+// shards, which are the least recently used ones of the shards. The idleness is
+// measured at the time, which is before the new statement is added, so the new
+// one is never idle.
+func (c *CacheDB) shrink(now time.Time) {
+	var closing []sql.Stmt
+	defer closeStmts(&closing)
+	c.evictMu.Lock()
+	defer c.evictMu.Unlock()
+	for {
+		size := 0
+		var oldest *cacheShard
+		var oldestElem *list.Element
+		var oldestUsed time.Time
+		for _, sh := range c.getShards() {
+			sh.mu.Lock()
+			closing = sh.evictIdle(now, c.IdleTTL, closing)
+			size += sh.lru.Len()
+			if elem := sh.lru.Back(); elem != nil {
+				if used := elem.Value.(*cacheEntry).lastUsed; oldest == nil || used.Before(oldestUsed) {
+					oldest, oldestElem, oldestUsed = sh, elem, used
+				}
+			}
+			sh.mu.Unlock()
+		}
+		if c.MaxSize <= 0 || size <= c.MaxSize {
+			return
+		}
+		// The oldest statement is evicted unless it has been used or removed
+		// since the scan, then the shards are scanned again.
+		oldest.mu.Lock()
+		if oldest.lru.Back() == oldestElem && oldestElem.Value.(*cacheEntry).lastUsed.Equal(oldestUsed) {
+			oldest.stats.Evictions++
+			closing = oldest.evict(oldestElem, closing)
+		}
+		oldest.mu.Unlock()
+	}
+}
+
+// add adds the statement of the query, which is not acquired. The caller
+// evicts the statements if the cache is full.
+func (sh *cacheShard) add(query string, stmt sql.Stmt) *cacheEntry {
+	var closing []sql.Stmt
+	defer closeStmts(&closing)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if elem := sh.stmts[query]; elem != nil {
+		closing = sh.evict(elem, closing)
+	}
+	e := &cacheEntry{query: query, stmt: stmt, lastUsed: time.Now()}
+	sh.stmts[query] = sh.lru.PushFront(e)
+	return e
+}
+
+// acquire acquires the entry unless it has been evicted.
+func (sh *cacheShard) acquire(e *cacheEntry) bool {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if e.evicted {
+		return false
+	}
+	e.refs++
+	return true
+}
+
+func (sh *cacheShard) release(e *cacheEntry) {
+	sh.mu.Lock()
+	e.refs--
+	closing := e.evicted && e.refs == 0
+	sh.mu.Unlock()
+	if closing {
+		_ = e.stmt.Close()
+	}
+}
+
+func (sh *cacheShard) remove(e *cacheEntry) {
+	var closing []sql.Stmt
+	defer closeStmts(&closing)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if elem := sh.stmts[e.query]; elem != nil && elem.Value == e {
+		closing = sh.evict(elem, closing)
+	}
+}
+
+// clear removes all the statements from the shard.
+func (sh *cacheShard) clear() {
+	var closing []sql.Stmt
+	defer closeStmts(&closing)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	for elem := sh.lru.Back(); elem != nil; elem = sh.lru.Back() {
+		closing = sh.evict(elem, closing)
+	}
+}
+
+// evictIdle evicts the statements idle for longer than the TTL, which are at
+// the back of the LRU list.
+func (sh *cacheShard) evictIdle(now time.Time, ttl time.Duration, closing []sql.Stmt) []sql.Stmt {
+	if ttl <= 0 {
+		return closing
+	}
+	for elem := sh.lru.Back(); elem != nil; elem = sh.lru.Back() {
+		if now.Sub(elem.Value.(*cacheEntry).lastUsed) <= ttl {
+			break
+		}
+		sh.stats.Evictions++
+		closing = sh.evict(elem, closing)
+	}
+	return closing
+}
+
+// evict removes the element from the shard, and appends the statement to the
+// closing ones if no one is using it. It must be called with the lock held.
+func (sh *cacheShard) evict(elem *list.Element, closing []sql.Stmt) []sql.Stmt {
+	e := elem.Value.(*cacheEntry)
+	sh.lru.Remove(elem)
+	delete(sh.stmts, e.query)
+	e.evicted = true
+	if e.refs == 0 {
+		closing = append(closing, e.stmt)
+	}
+	return closing
+}
+
+// closeStmts closes the statements, which is deferred before the lock is held,
+// so the statements are closed after the lock is released.
+func closeStmts(stmts *[]sql.Stmt) {
+	for _, stmt := range *stmts {
 		_ = stmt.Close()
 	}
 }
 
-func (c *CacheDB) ExecContext(ctx context.Context, query string, args ...interface{}) (stdSql.Result, error) {
-	stmt, err := c.getStmt(query)
-	if err != nil {
-		return c.DB.ExecContext(ctx, query, args...)
+func (c *CacheDB) BeginTx(ctx context.Context, opts *stdSql.TxOptions) (sql.Tx, error) {
+	tx, err := c.DB.BeginTx(ctx, opts)
+	return &CacheTx{Tx: tx, db: c}, err
+}
+
+func (c *CacheDB) Begin() (sql.Tx, error) {
+	return c.BeginTx(context.Background(), nil)
+}
+
+func (c *CacheDB) Conn(ctx context.Context) (sql.Conn, error) {
+	conn, err := c.DB.Conn(ctx)
+	return &CacheConn{Conn: conn, db: c}, err
+}
+
+// withStmt calls the function with the cached statement of the query, and
+// returns false if the statement can't be prepared, then the caller should fall
+// back to the inner DB. The statement is evicted if the function fails with an
+// error invalidating it, and the function is called once more with a new
+// statement if the error asks for a re-prepare.
+func (c *CacheDB) withStmt(ctx context.Context, query string, f func(stmt sql.Stmt) error) bool {
+	for retried := false; ; retried = true {
+		e, err := c.getStmt(ctx, query)
+		if err != nil {
+			return false
+		}
+		err = f(e.stmt)
+		c.release(e)
+		if err == nil || !mysqlerr.IsStmtInvalidated(err) {
+			return true
+		}
+		c.rmStmt(e)
+		if retried || !mysqlerr.Is(err, mysqlerr.ErNeedReprepare) {
+			return true
+		}
 	}
-	result, err := stmt.ExecContext(ctx, args...)
-	if err != nil {
-		c.rmStmt(query)
+}
+
+func (c *CacheDB) ExecContext(ctx context.Context, query string, args ...interface{}) (result sql.Result, err error) {
+	if !c.withStmt(ctx, query, func(stmt sql.Stmt) error {
+		result, err = stmt.ExecContext(ctx, args...)
+		return err
+	}) {
+		return c.DB.ExecContext(ctx, query, args...)
 	}
-	return result, err
+	return
 }
 
-func (c *CacheDB) Exec(query string, args ...interface{}) (stdSql.Result, error) {
-	stmt, err := c.getStmt(query)
-	if err != nil {
+func (c *CacheDB) Exec(query string, args ...interface{}) (result sql.Result, err error) {
+	if !c.withStmt(context.Background(), query, func(stmt sql.Stmt) error {
+		result, err = stmt.Exec(args...)
+		return err
+	}) {
 		return c.DB.Exec(query, args...)
 	}
-	result, err := stmt.Exec(args...)
-	if err != nil {
-		c.rmStmt(query)
-	}
-	return result, err
+	return
 }
-func (c *CacheDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*stdSql.Rows, error) {
-	stmt, err := c.getStmt(query)
-	if err != nil {
+
+func (c *CacheDB) QueryContext(ctx context.Context, query string, args ...interface{}) (rows sql.Rows, err error) {
+	if !c.withStmt(ctx, query, func(stmt sql.Stmt) error {
+		rows, err = stmt.QueryContext(ctx, args...)
+		return err
+	}) {
 		return c.DB.QueryContext(ctx, query, args...)
 	}
-	rows, err := stmt.QueryContext(ctx, args...)
-	if err != nil {
-		c.rmStmt(query)
-	}
-	return rows, err
+	return
 }
-func (c *CacheDB) Query(query string, args ...interface{}) (*stdSql.Rows, error) {
-	stmt, err := c.getStmt(query)
-	if err != nil {
+
+func (c *CacheDB) Query(query string, args ...interface{}) (rows sql.Rows, err error) {
+	if !c.withStmt(context.Background(), query, func(stmt sql.Stmt) error {
+		rows, err = stmt.Query(args...)
+		return err
+	}) {
 		return c.DB.Query(query, args...)
 	}
-	rows, err := stmt.Query(args...)
-	if err != nil {
-		c.rmStmt(query)
-	}
-	return rows, err
+	return
 }
-func (c *CacheDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *stdSql.Row {
-	stmt, err := c.getStmt(query)
-	if err != nil {
+
+func (c *CacheDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) (row sql.Row) {
+	if !c.withStmt(ctx, query, func(stmt sql.Stmt) error {
+		row = stmt.QueryRowContext(ctx, args...)
+		return row.Err()
+	}) {
 		return c.DB.QueryRowContext(ctx, query, args...)
 	}
-	row := stmt.QueryRowContext(ctx, args...)
-	if row.Err() != nil {
-		c.rmStmt(query)
-	}
-	return row
+	return
 }
-func (c *CacheDB) QueryRow(query string, args ...interface{}) *stdSql.Row {
-	stmt, err := c.getStmt(query)
-	if err != nil {
+
+func (c *CacheDB) QueryRow(query string, args ...interface{}) (row sql.Row) {
+	if !c.withStmt(context.Background(), query, func(stmt sql.Stmt) error {
+		row = stmt.QueryRow(args...)
+		return row.Err()
+	}) {
 		return c.DB.QueryRow(query, args...)
 	}
-	row := stmt.QueryRow(args...)
-	if row.Err() != nil {
-		c.rmStmt(query)
-	}
-	return row
+	return
 }
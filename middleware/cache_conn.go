@@ -0,0 +1,148 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"github.com/developerdong/sql"
+	"github.com/developerdong/sql/mysqlerr"
+	"sync"
+)
+
+var (
+	_ sql.Conn = (*CacheConn)(nil)
+)
+
+// CacheConn caches the prepared statements of the queries executed on the
+// dedicated connection, and executes the queries with the cached statements.
+// The statements are kept per connection, up to the MaxSize of the CacheDB, and
+// are closed on Close. The queries which don't fit in a full cache are
+// executed directly, without a statement.
+//
+// The transactions begun on the connection are not cached, because
+// database/sql prepares again a statement of a Conn bound to a transaction,
+// which would cost the round trip the cache saves.
+type CacheConn struct {
+	sql.Conn
+	db    *CacheDB
+	mu    sync.Mutex
+	stmts map[string]sql.Stmt
+}
+
+// Unwrap returns the wrapped Conn.
+func (c *CacheConn) Unwrap() sql.Conn {
+	return c.Conn
+}
+
+// errConnCacheFull is returned by CacheConn.getStmt if the query is not cached
+// and the cache is full.
+var errConnCacheFull = errors.New("the cache of the connection is full")
+
+// full reports whether no more statements can be cached. It must be called
+// with the lock held.
+func (c *CacheConn) full() bool {
+	return c.db.MaxSize > 0 && len(c.stmts) >= c.db.MaxSize
+}
+
+// getStmt returns the cached statement of the query, which is prepared if it
+// is not cached and the cache is not full.
+func (c *CacheConn) getStmt(ctx context.Context, query string) (sql.Stmt, error) {
+	query = c.db.normalize(query)
+	c.mu.Lock()
+	stmt, full := c.stmts[query], c.full()
+	c.mu.Unlock()
+	if stmt != nil {
+		return stmt, nil
+	}
+	if full {
+		return nil, errConnCacheFull
+	}
+	stmt, err := c.Conn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old := c.stmts[query]; old != nil {
+		_ = stmt.Close()
+		return old, nil
+	}
+	if c.full() {
+		_ = stmt.Close()
+		return nil, errConnCacheFull
+	}
+	if c.stmts == nil {
+		c.stmts = make(map[string]sql.Stmt)
+	}
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
+func (c *CacheConn) rmStmt(query string, stmt sql.Stmt) {
+	query = c.db.normalize(query)
+	c.mu.Lock()
+	if c.stmts[query] == stmt {
+		delete(c.stmts, query)
+	}
+	c.mu.Unlock()
+}
+
+// withStmt is the connection version of CacheDB.withStmt.
+func (c *CacheConn) withStmt(ctx context.Context, query string, f func(stmt sql.Stmt) error) bool {
+	for retried := false; ; retried = true {
+		stmt, err := c.getStmt(ctx, query)
+		if err != nil {
+			return false
+		}
+		err = f(stmt)
+		if err == nil || !mysqlerr.IsStmtInvalidated(err) {
+			return true
+		}
+		c.rmStmt(query, stmt)
+		_ = stmt.Close()
+		if retried || !mysqlerr.Is(err, mysqlerr.ErNeedReprepare) {
+			return true
+		}
+	}
+}
+
+func (c *CacheConn) ExecContext(ctx context.Context, query string, args ...interface{}) (result sql.Result, err error) {
+	if !c.withStmt(ctx, query, func(stmt sql.Stmt) error {
+		result, err = stmt.ExecContext(ctx, args...)
+		return err
+	}) {
+		return c.Conn.ExecContext(ctx, query, args...)
+	}
+	return
+}
+
+func (c *CacheConn) QueryContext(ctx context.Context, query string, args ...interface{}) (rows sql.Rows, err error) {
+	if !c.withStmt(ctx, query, func(stmt sql.Stmt) error {
+		rows, err = stmt.QueryContext(ctx, args...)
+		return err
+	}) {
+		return c.Conn.QueryContext(ctx, query, args...)
+	}
+	return
+}
+
+func (c *CacheConn) QueryRowContext(ctx context.Context, query string, args ...interface{}) (row sql.Row) {
+	if !c.withStmt(ctx, query, func(stmt sql.Stmt) error {
+		row = stmt.QueryRowContext(ctx, args...)
+		return row.Err()
+	}) {
+		return c.Conn.QueryRowContext(ctx, query, args...)
+	}
+	return
+}
+
+// Close closes all the cached statements and the connection.
+func (c *CacheConn) Close() error {
+	c.mu.Lock()
+	stmts := c.stmts
+	c.stmts = nil
+	c.mu.Unlock()
+	for _, stmt := range stmts {
+		_ = stmt.Close()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"container/list"
+	"context"
+	"database/sql/driver"
+	"github.com/developerdong/sql"
+	"github.com/developerdong/sql/mysqlerr"
+)
+
+var (
+	_ sql.DriverConn = (*CacheDriverConn)(nil)
+)
+
+// DefaultCacheDriverSize is the max number of the cached statements of a
+// CacheDriverConn if MaxSize is 0.
+const DefaultCacheDriverSize = 64
+
+// CacheDriverConn is the driver-level counterpart of CacheDB. It caches the
+// prepared statements of the queries executed directly on the connection, and
+// executes the queries with the cached statements. The cached statements are
+// closed with the connection.
+//
+// The statements are cached per connection, so the server holds up to MaxSize
+// statements for each connection of the pool, which counts against
+// max_prepared_stmt_count.
+//
+// The database/sql package never uses a driver connection concurrently, so no
+// lock is needed here.
+type CacheDriverConn struct {
+	sql.DriverConn
+	// MaxSize is the max number of the cached statements. The least recently
+	// used statement is evicted and closed if the cache is full.
+	// DefaultCacheDriverSize is used if it is 0, and there is no limit if it
+	// is negative.
+	MaxSize int
+
+	stmts map[string]*list.Element
+	lru   list.List
+}
+
+// cacheDriverEntry is the value of the elements in the LRU list.
+type cacheDriverEntry struct {
+	query string
+	stmt  sql.DriverStmt
+}
+
+// NewCacheDriverConn wraps the DriverConn with a CacheDriverConn. It fits the
+// sql.DriverMiddleware type.
+func NewCacheDriverConn(conn sql.DriverConn) sql.DriverConn {
+	return &CacheDriverConn{DriverConn: conn}
+}
+
+// CacheDriver returns a driver middleware which wraps the connections with a
+// CacheDriverConn caching up to maxSize statements.
+func CacheDriver(maxSize int) sql.DriverMiddleware {
+	return func(conn sql.DriverConn) sql.DriverConn {
+		return &CacheDriverConn{DriverConn: conn, MaxSize: maxSize}
+	}
+}
+
+func (c *CacheDriverConn) getStmt(ctx context.Context, query string) (sql.DriverStmt, error) {
+	if elem := c.stmts[query]; elem != nil {
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*cacheDriverEntry).stmt, nil
+	}
+	stmt, err := c.DriverConn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if c.stmts == nil {
+		c.stmts = make(map[string]*list.Element)
+	}
+	c.stmts[query] = c.lru.PushFront(&cacheDriverEntry{query, stmt})
+	maxSize := c.MaxSize
+	if maxSize == 0 {
+		maxSize = DefaultCacheDriverSize
+	}
+	for maxSize > 0 && c.lru.Len() > maxSize {
+		c.rmStmt(c.lru.Back().Value.(*cacheDriverEntry).query)
+	}
+	return stmt, nil
+}
+
+func (c *CacheDriverConn) rmStmt(query string) {
+	if elem := c.stmts[query]; elem != nil {
+		delete(c.stmts, query)
+		c.lru.Remove(elem)
+		_ = elem.Value.(*cacheDriverEntry).stmt.Close()
+	}
+}
+
+// withStmt is the driver-level counterpart of CacheDB.withStmt.
+func (c *CacheDriverConn) withStmt(ctx context.Context, query string, f func(stmt sql.DriverStmt) error) bool {
+	for retried := false; ; retried = true {
+		stmt, err := c.getStmt(ctx, query)
+		if err != nil {
+			return false
+		}
+		err = f(stmt)
+		if err == nil || !mysqlerr.IsStmtInvalidated(err) {
+			return true
+		}
+		c.rmStmt(query)
+		if retried || !mysqlerr.Is(err, mysqlerr.ErNeedReprepare) {
+			return true
+		}
+	}
+}
+
+func (c *CacheDriverConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (result driver.Result, err error) {
+	if !c.withStmt(ctx, query, func(stmt sql.DriverStmt) error {
+		result, err = stmt.ExecContext(ctx, args)
+		return err
+	}) {
+		return c.DriverConn.ExecContext(ctx, query, args)
+	}
+	return
+}
+
+func (c *CacheDriverConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (rows sql.DriverRows, err error) {
+	if !c.withStmt(ctx, query, func(stmt sql.DriverStmt) error {
+		rows, err = stmt.QueryContext(ctx, args)
+		return err
+	}) {
+		return c.DriverConn.QueryContext(ctx, query, args)
+	}
+	return
+}
+
+func (c *CacheDriverConn) Close() error {
+	for query := range c.stmts {
+		c.rmStmt(query)
+	}
+	return c.DriverConn.Close()
+}
@@ -3,10 +3,16 @@ package middleware
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	s "github.com/developerdong/sql"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/developerdong/sql/mysqlerr"
+	"github.com/go-sql-driver/mysql"
 	"golang.org/x/sync/errgroup"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 const (
@@ -99,3 +105,295 @@ func TestDB_QueryRowContext_Concurrent(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestCacheDB_CacheStats(t *testing.T) {
+	db, d := openFake()
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	cacheDb := &CacheDB{DB: &s.BaseDB{DB: db}, MaxSize: 2, IdleTTL: time.Hour}
+	ctx := context.Background()
+	for _, query := range []string{"SELECT 1", "SELECT 2", "SELECT 1", "SELECT 3", "SELECT 2"} {
+		if _, err := cacheDb.ExecContext(ctx, query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := CacheStats{Hits: 1, Misses: 4, Evictions: 2, Size: 2}
+	if stats := cacheDb.CacheStats(); stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+	if prepares := atomic.LoadInt64(&d.prepares); prepares != 4 {
+		t.Fatalf("expected 4 prepares, got %d", prepares)
+	}
+	cacheDb.IdleTTL = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if _, err := cacheDb.ExecContext(ctx, "SELECT 2"); err != nil {
+		t.Fatal(err)
+	}
+	expected = CacheStats{Hits: 1, Misses: 5, Evictions: 4, Size: 1}
+	if stats := cacheDb.CacheStats(); stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestCacheDB_GlobalLRU(t *testing.T) {
+	db, d := openFake()
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	cacheDb := &CacheDB{DB: &s.BaseDB{DB: db}, MaxSize: 16}
+	ctx := context.Background()
+	// The queries hashed to the same shard don't evict each other while the
+	// cache is not full.
+	for i := 0; i < 100; i++ {
+		if _, err := cacheDb.ExecContext(ctx, fmt.Sprintf("SELECT %d", 5+i%2*5)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if prepares := atomic.LoadInt64(&d.prepares); prepares != 2 {
+		t.Fatalf("expected 2 prepares, got %d", prepares)
+	}
+	for i := 0; i < 16; i++ {
+		if _, err := cacheDb.ExecContext(ctx, fmt.Sprintf("SELECT %d", 100+i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// SELECT 5 and SELECT 10 are the least recently used across the shards.
+	expected := CacheStats{Hits: 98, Misses: 18, Evictions: 2, Size: 16}
+	if stats := cacheDb.CacheStats(); stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+	for i := 0; i < 16; i++ {
+		if _, err := cacheDb.ExecContext(ctx, fmt.Sprintf("SELECT %d", 100+i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if prepares := atomic.LoadInt64(&d.prepares); prepares != 18 {
+		t.Fatalf("expected 18 prepares, got %d", prepares)
+	}
+}
+
+func TestCacheDB_SharedPrepare(t *testing.T) {
+	db, d := openFake()
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	d.slowPrepare = 10 * time.Millisecond
+	cacheDb := &CacheDB{DB: &s.BaseDB{DB: db}}
+	g, ctx := errgroup.WithContext(context.Background())
+	for i := 0; i < 10; i++ {
+		g.Go(func() error {
+			_, err := cacheDb.ExecContext(ctx, "SLOW")
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if prepares := atomic.LoadInt64(&d.prepares); prepares != 1 {
+		t.Fatalf("expected 1 prepare, got %d", prepares)
+	}
+}
+
+func TestCacheDB_Invalidation(t *testing.T) {
+	db, d := openFake()
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	cacheDb := &CacheDB{DB: &s.BaseDB{DB: db}}
+	ctx := context.Background()
+	var failure error
+	d.setFail(func(string) error {
+		err := failure
+		failure = nil
+		return err
+	})
+	if _, err := cacheDb.ExecContext(ctx, "INSERT INTO t VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	failure = &mysql.MySQLError{Number: 1062}
+	if _, err := cacheDb.ExecContext(ctx, "INSERT INTO t VALUES (1)"); !mysqlerr.Is(err, 1062) {
+		t.Fatalf("expected a duplicate key error, got %v", err)
+	}
+	if prepares := atomic.LoadInt64(&d.prepares); prepares != 1 {
+		t.Fatalf("expected the statement to be kept, got %d prepares", prepares)
+	}
+	failure = &mysql.MySQLError{Number: mysqlerr.ErNeedReprepare}
+	if _, err := cacheDb.ExecContext(ctx, "INSERT INTO t VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	if prepares := atomic.LoadInt64(&d.prepares); prepares != 2 {
+		t.Fatalf("expected the statement to be re-prepared, got %d prepares", prepares)
+	}
+}
+
+// BenchmarkCacheDB_SlowPrepare executes a cached query in parallel, while the
+// slow prepares of other queries are in flight.
+// BenchmarkCacheDB_SlowPrepare measures the latency of the cache hits without
+// and with slow prepares of other queries in flight, which should be the same
+// since the prepares hold no lock.
+func BenchmarkCacheDB_SlowPrepare(b *testing.B) {
+	for _, slow := range []int{0, 4} {
+		b.Run(fmt.Sprintf("prepares=%d", slow), func(b *testing.B) {
+			db, d := openFake()
+			defer func(db *sql.DB) {
+				_ = db.Close()
+			}(db)
+			d.slowPrepare = time.Millisecond
+			cacheDb := &CacheDB{DB: &s.BaseDB{DB: db}, MaxSize: 64}
+			ctx, cancel := context.WithCancel(context.Background())
+			var wg sync.WaitGroup
+			defer wg.Wait()
+			defer cancel()
+			if _, err := cacheDb.ExecContext(ctx, "SELECT 1"); err != nil {
+				b.Fatal(err)
+			}
+			for i := 0; i < slow; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; ctx.Err() == nil; j++ {
+						_, _ = cacheDb.ExecContext(ctx, fmt.Sprintf("SLOW %d %d", i, j))
+					}
+				}(i)
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					e, err := cacheDb.getStmt(context.Background(), "SELECT 1")
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					cacheDb.release(e)
+				}
+			})
+		})
+	}
+}
+
+func TestCacheTx(t *testing.T) {
+	db, d := openFake()
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	cacheDb := &CacheDB{DB: &s.BaseDB{DB: db}}
+	ctx := context.Background()
+	tx, err := cacheDb.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheTx := tx.(*CacheTx)
+	for i := 0; i < 2; i++ {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO t VALUES (1)"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(cacheTx.stmts) != 1 {
+		t.Fatalf("expected 1 statement in the transaction, got %d", len(cacheTx.stmts))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if cacheTx.stmts != nil {
+		t.Fatal("expected the statements to be released on commit")
+	}
+	if _, err := cacheDb.ExecContext(ctx, "INSERT INTO t VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	expected := CacheStats{Hits: 1, Misses: 1, Size: 1}
+	if stats := cacheDb.CacheStats(); stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+	expectedQueries := []string{"BEGIN", "INSERT INTO t VALUES (1);", "INSERT INTO t VALUES (1);", "COMMIT", "INSERT INTO t VALUES (1);"}
+	if queries := d.executed(); !reflect.DeepEqual(queries, expectedQueries) {
+		t.Fatalf("expected %q, got %q", expectedQueries, queries)
+	}
+}
+
+func TestCacheConn(t *testing.T) {
+	db, d := openFake()
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	cacheDb := &CacheDB{DB: &s.BaseDB{DB: db}, MaxSize: 1}
+	ctx := context.Background()
+	conn, err := cacheDb.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SELECT 2 is executed directly, without a statement, because the cache
+	// of the connection is full. The prepared queries are normalized with a
+	// terminating semicolon.
+	for _, query := range []string{"SELECT 1", "SELECT 1", "SELECT 2", "SELECT 2"} {
+		var value string
+		if err := conn.QueryRowContext(ctx, query).Scan(&value); err != nil {
+			t.Fatal(err)
+		}
+		expected := query
+		if query == "SELECT 1" {
+			expected += ";"
+		}
+		if value != expected {
+			t.Fatalf("expected %q, got %q", expected, value)
+		}
+	}
+	if prepares := atomic.LoadInt64(&d.prepares); prepares != 1 {
+		t.Fatalf("expected 1 prepare, got %d", prepares)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if conn.(*CacheConn).stmts != nil {
+		t.Fatal("expected the statements to be closed on close")
+	}
+}
+
+func TestCacheDB_Lifecycle(t *testing.T) {
+	db, _ := openFake()
+	cacheDb := &CacheDB{DB: &s.BaseDB{DB: db}}
+	ctx := context.Background()
+	failed := cacheDb.Warmup(ctx, []string{"SELECT 1", "SELECT 2", "BAD"})
+	if len(failed) != 1 || failed["BAD"] != errBadPrepare {
+		t.Fatalf("expected BAD to fail, got %v", failed)
+	}
+	if size := cacheDb.CacheStats().Size; size != 2 {
+		t.Fatalf("expected 2 cached statements, got %d", size)
+	}
+	if !cacheDb.Evict("SELECT 1") || cacheDb.Evict("SELECT 1") {
+		t.Fatal("expected SELECT 1 to be evicted once")
+	}
+	cacheDb.Flush()
+	if size := cacheDb.CacheStats().Size; size != 0 {
+		t.Fatalf("expected an empty cache, got %d", size)
+	}
+	if _, err := cacheDb.ExecContext(ctx, "SELECT 1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cacheDb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if size := cacheDb.CacheStats().Size; size != 0 {
+		t.Fatalf("expected an empty cache after close, got %d", size)
+	}
+	if err := db.Ping(); err == nil {
+		t.Fatal("expected the inner DB to be closed")
+	}
+}
+
+func TestCacheDB_Normalizer(t *testing.T) {
+	db, d := openFake()
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	cacheDb := &CacheDB{DB: &s.BaseDB{DB: db}, Normalizer: StripComments}
+	ctx := context.Background()
+	for _, query := range []string{"SELECT 1 FROM t", "SELECT 1\n  FROM t", "SELECT 1 FROM t /* caller */"} {
+		if _, err := cacheDb.ExecContext(ctx, query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if prepares := atomic.LoadInt64(&d.prepares); prepares != 1 {
+		t.Fatalf("expected 1 prepare, got %d", prepares)
+	}
+}
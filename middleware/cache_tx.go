@@ -0,0 +1,160 @@
+package middleware
+
+import (
+	"context"
+	"github.com/developerdong/sql"
+	"github.com/developerdong/sql/mysqlerr"
+	"sync"
+)
+
+var (
+	_ sql.Tx = (*CacheTx)(nil)
+)
+
+// CacheTx executes the queries in the transaction with the statements cached by
+// the CacheDB, which are bound to the transaction by Tx.StmtContext. The bound
+// statements are reused in the transaction, and are released on Commit or
+// Rollback.
+type CacheTx struct {
+	sql.Tx
+	db    *CacheDB
+	mu    sync.Mutex
+	stmts map[string]*cacheTxStmt
+}
+
+// cacheTxStmt is a statement bound to the transaction, which holds the cached
+// entry until it is closed.
+type cacheTxStmt struct {
+	query string
+	entry *cacheEntry
+	stmt  sql.Stmt
+}
+
+// Unwrap returns the wrapped Tx.
+func (t *CacheTx) Unwrap() sql.Tx {
+	return t.Tx
+}
+
+func (t *CacheTx) getStmt(ctx context.Context, query string) (*cacheTxStmt, error) {
+	query = t.db.normalize(query)
+	t.mu.Lock()
+	s := t.stmts[query]
+	t.mu.Unlock()
+	if s != nil {
+		return s, nil
+	}
+	e, err := t.db.getStmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	s = &cacheTxStmt{query, e, t.Tx.StmtContext(ctx, e.stmt)}
+	t.mu.Lock()
+	if old := t.stmts[query]; old != nil {
+		t.mu.Unlock()
+		t.closeStmt(s)
+		return old, nil
+	}
+	if t.stmts == nil {
+		t.stmts = make(map[string]*cacheTxStmt)
+	}
+	t.stmts[query] = s
+	t.mu.Unlock()
+	return s, nil
+}
+
+func (t *CacheTx) closeStmt(s *cacheTxStmt) {
+	_ = s.stmt.Close()
+	t.db.release(s.entry)
+}
+
+// rmStmt removes the statement from the transaction and evicts the cached one.
+func (t *CacheTx) rmStmt(s *cacheTxStmt) {
+	t.mu.Lock()
+	if t.stmts[s.query] == s {
+		delete(t.stmts, s.query)
+	}
+	t.mu.Unlock()
+	t.db.rmStmt(s.entry)
+	t.closeStmt(s)
+}
+
+// releaseAll closes all the statements bound to the transaction.
+func (t *CacheTx) releaseAll() {
+	t.mu.Lock()
+	stmts := t.stmts
+	t.stmts = nil
+	t.mu.Unlock()
+	for _, s := range stmts {
+		t.closeStmt(s)
+	}
+}
+
+// withStmt is the transaction version of CacheDB.withStmt.
+func (t *CacheTx) withStmt(ctx context.Context, query string, f func(stmt sql.Stmt) error) bool {
+	for retried := false; ; retried = true {
+		s, err := t.getStmt(ctx, query)
+		if err != nil {
+			return false
+		}
+		err = f(s.stmt)
+		if err == nil || !mysqlerr.IsStmtInvalidated(err) {
+			return true
+		}
+		t.rmStmt(s)
+		if retried || !mysqlerr.Is(err, mysqlerr.ErNeedReprepare) {
+			return true
+		}
+	}
+}
+
+func (t *CacheTx) Commit() error {
+	defer t.releaseAll()
+	return t.Tx.Commit()
+}
+
+func (t *CacheTx) Rollback() error {
+	defer t.releaseAll()
+	return t.Tx.Rollback()
+}
+
+func (t *CacheTx) ExecContext(ctx context.Context, query string, args ...interface{}) (result sql.Result, err error) {
+	if !t.withStmt(ctx, query, func(stmt sql.Stmt) error {
+		result, err = stmt.ExecContext(ctx, args...)
+		return err
+	}) {
+		return t.Tx.ExecContext(ctx, query, args...)
+	}
+	return
+}
+
+func (t *CacheTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return t.ExecContext(context.Background(), query, args...)
+}
+
+func (t *CacheTx) QueryContext(ctx context.Context, query string, args ...interface{}) (rows sql.Rows, err error) {
+	if !t.withStmt(ctx, query, func(stmt sql.Stmt) error {
+		rows, err = stmt.QueryContext(ctx, args...)
+		return err
+	}) {
+		return t.Tx.QueryContext(ctx, query, args...)
+	}
+	return
+}
+
+func (t *CacheTx) Query(query string, args ...interface{}) (sql.Rows, error) {
+	return t.QueryContext(context.Background(), query, args...)
+}
+
+func (t *CacheTx) QueryRowContext(ctx context.Context, query string, args ...interface{}) (row sql.Row) {
+	if !t.withStmt(ctx, query, func(stmt sql.Stmt) error {
+		row = stmt.QueryRowContext(ctx, args...)
+		return row.Err()
+	}) {
+		return t.Tx.QueryRowContext(ctx, query, args...)
+	}
+	return
+}
+
+func (t *CacheTx) QueryRow(query string, args ...interface{}) sql.Row {
+	return t.QueryRowContext(context.Background(), query, args...)
+}
@@ -0,0 +1,380 @@
+package middleware
+
+import (
+	"context"
+	stdSql "database/sql"
+	"github.com/developerdong/sql"
+	"github.com/developerdong/sql/sqlparse"
+	"github.com/opentracing/opentracing-go"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	_ sql.DB   = (*CommentDB)(nil)
+	_ sql.Tx   = (*CommentTx)(nil)
+	_ sql.Conn = (*CommentConn)(nil)
+)
+
+// CommentPosition is where CommentDB puts the comment in a query.
+type CommentPosition int
+
+const (
+	// CommentAppend puts the comment at the end of the query, before the
+	// terminating semicolon, as sqlcommenter does. The comment is put on a new
+	// line after a trailing line comment.
+	CommentAppend CommentPosition = iota
+	// CommentPrepend puts the comment at the beginning of the query, so it
+	// survives the truncation of long queries in the slow query log and
+	// performance_schema.
+	CommentPrepend
+)
+
+// CommentOptions are the options of a CommentDB.
+type CommentOptions struct {
+	// Tracer injects the span in the context into the comment.
+	// opentracing.GlobalTracer() is used if it is nil.
+	Tracer opentracing.Tracer
+	// Tags are the static tags of all the comments, such as application. The
+	// tags in the context and of the span override them.
+	Tags map[string]string
+	// Position is where the comment is put, CommentAppend by default.
+	Position CommentPosition
+	// CommentPrepares adds the static Tags to the prepared queries. The span
+	// and the tags in the context are never added to them, because a
+	// statement outlives the call preparing it. The prepared queries are not
+	// commented if it is false.
+	CommentPrepares bool
+}
+
+type commentTagsKey struct{}
+
+// WithCommentTags returns a context with the tags added to the comments by
+// CommentDB, such as route. They override the tags with the same keys in the
+// parent context.
+func WithCommentTags(ctx context.Context, tags map[string]string) context.Context {
+	parent := CommentTags(ctx)
+	merged := make(map[string]string, len(parent)+len(tags))
+	for k, v := range parent {
+		merged[k] = v
+	}
+	for k, v := range tags {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, commentTagsKey{}, merged)
+}
+
+// CommentTags returns the tags added to the context by WithCommentTags. The
+// returned map must not be modified.
+func CommentTags(ctx context.Context) map[string]string {
+	tags, _ := ctx.Value(commentTagsKey{}).(map[string]string)
+	return tags
+}
+
+// CommentDB adds a sqlcommenter comment to the queries, such as
+// /*application='api',route='%2Fusers',traceparent='00-...-01'*/, so the slow
+// query log and performance_schema can be correlated with the traces. The
+// comment is made of the static tags, the tags in the context, and the text
+// map injected by the tracer from the span in the context, which is
+// traceparent and tracestate for a W3C tracer. The keys are sorted, and the
+// values are URL-encoded and quoted.
+//
+// TraceDB must wrap CommentDB, so the comment refers to the span of the query
+// started by TraceDB. If CommentDB wraps TraceDB instead, the comment refers to
+// the parent span.
+//
+// Only the queries executed directly are commented with the span and the tags
+// in the context, since a prepared statement is shared by many calls. CacheDB
+// executes every query with a prepared statement, so the span never reaches
+// the server through it: if CacheDB wraps CommentDB, the prepared queries are
+// commented with the static tags only if CommentPrepares is true, and if
+// CommentDB finds a CacheDB beneath it with sql.As, it comments all the
+// queries with the static tags only, so the cache holds a statement per query
+// whatever its Normalizer is.
+//
+// The context-less methods are routed to the context variants with
+// context.Background().
+type CommentDB struct {
+	sql.DB
+	Options CommentOptions
+
+	once   sync.Once
+	cached bool
+}
+
+// NewCommentDB wraps the DB with a CommentDB. It fits the sql.Middleware type.
+func NewCommentDB(db sql.DB) sql.DB {
+	return &CommentDB{DB: db}
+}
+
+// Comment returns a middleware which wraps the DB with a CommentDB.
+func Comment(opts CommentOptions) sql.Middleware {
+	return func(db sql.DB) sql.DB {
+		return &CommentDB{DB: db, Options: opts}
+	}
+}
+
+// Unwrap returns the wrapped DB.
+func (c *CommentDB) Unwrap() sql.DB {
+	return c.DB
+}
+
+// isCached reports whether there is a CacheDB beneath, which is looked up at
+// the first use.
+func (c *CommentDB) isCached() bool {
+	c.once.Do(func() {
+		var cacheDb *CacheDB
+		c.cached = sql.As(c.DB, &cacheDb)
+	})
+	return c.cached
+}
+
+// comment returns the query with the comment of the context, or of the static
+// tags only if there is a CacheDB beneath.
+func (c *CommentDB) comment(ctx context.Context, query string) string {
+	if c.isCached() {
+		return c.commentPrepare(query)
+	}
+	tags := CommentTags(ctx)
+	var carrier opentracing.TextMapCarrier
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		tracer := c.Options.Tracer
+		if tracer == nil {
+			tracer = opentracing.GlobalTracer()
+		}
+		carrier = opentracing.TextMapCarrier{}
+		if tracer.Inject(span.Context(), opentracing.TextMap, carrier) != nil {
+			carrier = nil
+		}
+	}
+	if len(tags) == 0 && len(carrier) == 0 {
+		return c.commentPrepare(query)
+	}
+	merged := make(map[string]string, len(c.Options.Tags)+len(tags)+len(carrier))
+	for _, m := range []map[string]string{c.Options.Tags, tags, carrier} {
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
+	return c.addComment(query, merged)
+}
+
+// commentPrepare returns the query with the comment of the static tags, if
+// any.
+func (c *CommentDB) commentPrepare(query string) string {
+	if len(c.Options.Tags) == 0 {
+		return query
+	}
+	return c.addComment(query, c.Options.Tags)
+}
+
+// addComment puts the comment of the tags in the query.
+func (c *CommentDB) addComment(query string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.Grow(len(query) + 64*len(keys))
+	if c.Options.Position == CommentPrepend {
+		writeComment(&b, keys, tags)
+		b.WriteByte(' ')
+		b.WriteString(query)
+		return b.String()
+	}
+	end, lineComment := appendPosition(query)
+	b.WriteString(query[:end])
+	if lineComment {
+		// The comment would be a part of the line comment.
+		b.WriteByte('\n')
+	} else {
+		b.WriteByte(' ')
+	}
+	writeComment(&b, keys, tags)
+	b.WriteString(query[end:])
+	return b.String()
+}
+
+// appendPosition returns the position to append the comment at, which is
+// before the terminating semicolons and whitespace, and whether the query has
+// a line comment ending there.
+func appendPosition(query string) (int, bool) {
+	end, lineComment := 0, false
+	t := sqlparse.NewTokenizer(query)
+	prev := 0
+	for {
+		token := t.Next()
+		// The text between the tokens is whitespace or the markers of the
+		// executable comments.
+		for i := token.Pos; i > prev; i-- {
+			if !sqlparse.IsSpace(query[i-1]) {
+				end, lineComment = i, false
+				break
+			}
+		}
+		if token.Type == sqlparse.EOF {
+			return end, lineComment
+		}
+		prev = token.Pos + len(token.Text)
+		if !token.IsSymbol(";") {
+			end = prev
+			lineComment = token.Type == sqlparse.Comment && !strings.HasPrefix(token.Text, "/*")
+		}
+	}
+}
+
+// writeComment writes the comment of the tags in the order of the keys.
+func writeComment(b *strings.Builder, keys []string, tags map[string]string) {
+	b.WriteString("/*")
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(commentEscape(k))
+		b.WriteString("='")
+		b.WriteString(commentEscape(tags[k]))
+		b.WriteByte('\'')
+	}
+	b.WriteString("*/")
+}
+
+// commentEscape URL-encodes the string with %20 for the spaces. The quotes and
+// the asterisks are encoded too, so the string can't end the comment.
+func commentEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func (c *CommentDB) PrepareContext(ctx context.Context, query string) (sql.Stmt, error) {
+	if c.Options.CommentPrepares {
+		query = c.commentPrepare(query)
+	}
+	return c.DB.PrepareContext(ctx, query)
+}
+
+func (c *CommentDB) Prepare(query string) (sql.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *CommentDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return c.DB.ExecContext(ctx, c.comment(ctx, query), args...)
+}
+
+func (c *CommentDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.ExecContext(context.Background(), query, args...)
+}
+
+func (c *CommentDB) QueryContext(ctx context.Context, query string, args ...interface{}) (sql.Rows, error) {
+	return c.DB.QueryContext(ctx, c.comment(ctx, query), args...)
+}
+
+func (c *CommentDB) Query(query string, args ...interface{}) (sql.Rows, error) {
+	return c.QueryContext(context.Background(), query, args...)
+}
+
+func (c *CommentDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) sql.Row {
+	return c.DB.QueryRowContext(ctx, c.comment(ctx, query), args...)
+}
+
+func (c *CommentDB) QueryRow(query string, args ...interface{}) sql.Row {
+	return c.QueryRowContext(context.Background(), query, args...)
+}
+
+func (c *CommentDB) BeginTx(ctx context.Context, opts *stdSql.TxOptions) (sql.Tx, error) {
+	tx, err := c.DB.BeginTx(ctx, opts)
+	return &CommentTx{tx, c}, err
+}
+
+func (c *CommentDB) Begin() (sql.Tx, error) {
+	return c.BeginTx(context.Background(), nil)
+}
+
+func (c *CommentDB) Conn(ctx context.Context) (sql.Conn, error) {
+	conn, err := c.DB.Conn(ctx)
+	return &CommentConn{conn, c}, err
+}
+
+// CommentTx comments the queries in the transaction in the same way as
+// CommentDB.
+type CommentTx struct {
+	sql.Tx
+	db *CommentDB
+}
+
+// Unwrap returns the wrapped Tx.
+func (t *CommentTx) Unwrap() sql.Tx {
+	return t.Tx
+}
+
+func (t *CommentTx) PrepareContext(ctx context.Context, query string) (sql.Stmt, error) {
+	if t.db.Options.CommentPrepares {
+		query = t.db.commentPrepare(query)
+	}
+	return t.Tx.PrepareContext(ctx, query)
+}
+
+func (t *CommentTx) Prepare(query string) (sql.Stmt, error) {
+	return t.PrepareContext(context.Background(), query)
+}
+
+func (t *CommentTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return t.Tx.ExecContext(ctx, t.db.comment(ctx, query), args...)
+}
+
+func (t *CommentTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return t.ExecContext(context.Background(), query, args...)
+}
+
+func (t *CommentTx) QueryContext(ctx context.Context, query string, args ...interface{}) (sql.Rows, error) {
+	return t.Tx.QueryContext(ctx, t.db.comment(ctx, query), args...)
+}
+
+func (t *CommentTx) Query(query string, args ...interface{}) (sql.Rows, error) {
+	return t.QueryContext(context.Background(), query, args...)
+}
+
+func (t *CommentTx) QueryRowContext(ctx context.Context, query string, args ...interface{}) sql.Row {
+	return t.Tx.QueryRowContext(ctx, t.db.comment(ctx, query), args...)
+}
+
+func (t *CommentTx) QueryRow(query string, args ...interface{}) sql.Row {
+	return t.QueryRowContext(context.Background(), query, args...)
+}
+
+// CommentConn comments the queries on the connection in the same way as
+// CommentDB.
+type CommentConn struct {
+	sql.Conn
+	db *CommentDB
+}
+
+// Unwrap returns the wrapped Conn.
+func (c *CommentConn) Unwrap() sql.Conn {
+	return c.Conn
+}
+
+func (c *CommentConn) PrepareContext(ctx context.Context, query string) (sql.Stmt, error) {
+	if c.db.Options.CommentPrepares {
+		query = c.db.commentPrepare(query)
+	}
+	return c.Conn.PrepareContext(ctx, query)
+}
+
+func (c *CommentConn) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return c.Conn.ExecContext(ctx, c.db.comment(ctx, query), args...)
+}
+
+func (c *CommentConn) QueryContext(ctx context.Context, query string, args ...interface{}) (sql.Rows, error) {
+	return c.Conn.QueryContext(ctx, c.db.comment(ctx, query), args...)
+}
+
+func (c *CommentConn) QueryRowContext(ctx context.Context, query string, args ...interface{}) sql.Row {
+	return c.Conn.QueryRowContext(ctx, c.db.comment(ctx, query), args...)
+}
+
+func (c *CommentConn) BeginTx(ctx context.Context, opts *stdSql.TxOptions) (sql.Tx, error) {
+	tx, err := c.Conn.BeginTx(ctx, opts)
+	return &CommentTx{tx, c.db}, err
+}
@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	s "github.com/developerdong/sql"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCommentDB(t *testing.T) {
+	db, d := openFake()
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	tracer := mocktracer.New()
+	commentDb := &CommentDB{DB: &s.BaseDB{DB: db}, Options: CommentOptions{
+		Tracer: tracer,
+		Tags:   map[string]string{"application": "api", "route": "none"},
+	}}
+	span := tracer.StartSpan("request")
+	ctx := opentracing.ContextWithSpan(context.Background(), span)
+	ctx = WithCommentTags(ctx, map[string]string{"route": "/users"})
+	if _, err := commentDb.ExecContext(ctx, "UPDATE t SET a = 1;"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := commentDb.Exec("UPDATE t SET a = 2"); err != nil {
+		t.Fatal(err)
+	}
+	spanContext := span.Context().(mocktracer.MockSpanContext)
+	expected := []string{
+		fmt.Sprintf("UPDATE t SET a = 1 /*application='api',mockpfx-ids-sampled='true',mockpfx-ids-spanid='%d',mockpfx-ids-traceid='%d',route='%%2Fusers'*/;",
+			spanContext.SpanID, spanContext.TraceID),
+		"UPDATE t SET a = 2 /*application='api',route='none'*/",
+	}
+	if queries := d.executed(); !reflect.DeepEqual(queries, expected) {
+		t.Fatalf("expected %q, got %q", expected, queries)
+	}
+}
+
+func TestCommentDB_TraceDB(t *testing.T) {
+	db, d := openFake()
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	tracer := mocktracer.New()
+	traceDb := &TraceDB{DB: &CommentDB{DB: &s.BaseDB{DB: db}, Options: CommentOptions{Tracer: tracer}}, Options: TraceOptions{Tracer: tracer}}
+	span := tracer.StartSpan("request")
+	ctx := opentracing.ContextWithSpan(context.Background(), span)
+	if _, err := traceDb.ExecContext(ctx, "UPDATE t SET a = 1"); err != nil {
+		t.Fatal(err)
+	}
+	span.Finish()
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 || spans[0].OperationName != "ExecContext" {
+		t.Fatalf("expected the ExecContext span, got %v", spans)
+	}
+	// The comment refers to the span of the query, not the parent span.
+	expected := []string{
+		fmt.Sprintf("UPDATE t SET a = 1 /*mockpfx-ids-sampled='true',mockpfx-ids-spanid='%d',mockpfx-ids-traceid='%d'*/",
+			spans[0].SpanContext.SpanID, spans[0].SpanContext.TraceID),
+	}
+	if queries := d.executed(); !reflect.DeepEqual(queries, expected) {
+		t.Fatalf("expected %q, got %q", expected, queries)
+	}
+	if spans[0].SpanContext.SpanID == span.Context().(mocktracer.MockSpanContext).SpanID {
+		t.Fatal("expected the span of the query to differ from the parent span")
+	}
+}
+
+func TestCommentDB_Prepend(t *testing.T) {
+	db, _ := openFake()
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	commentDb := &CommentDB{DB: &s.BaseDB{DB: db}, Options: CommentOptions{Position: CommentPrepend}}
+	ctx := WithCommentTags(context.Background(), map[string]string{"route": "it's */ done"})
+	var value string
+	if err := commentDb.QueryRowContext(ctx, "SELECT 1").Scan(&value); err != nil {
+		t.Fatal(err)
+	}
+	// The quote and the end of the comment are escaped.
+	expected := "/*route='it%27s%20%2A%2F%20done'*/ SELECT 1"
+	if value != expected {
+		t.Fatalf("expected %q, got %q", expected, value)
+	}
+}
+
+func TestCommentDB_Append(t *testing.T) {
+	commentDb := &CommentDB{Options: CommentOptions{Tags: map[string]string{"application": "api"}}}
+	for query, expected := range map[string]string{
+		"SELECT 1":                         "SELECT 1 /*application='api'*/",
+		"SELECT 1; \n":                     "SELECT 1 /*application='api'*/; \n",
+		"SELECT 1 -- note":                 "SELECT 1 -- note\n/*application='api'*/",
+		"SELECT 1 # note\n;":               "SELECT 1 # note\n/*application='api'*/\n;",
+		"SELECT 1 -- note;":                "SELECT 1 -- note;\n/*application='api'*/",
+		"SELECT 1 /* note */;":             "SELECT 1 /* note */ /*application='api'*/;",
+		"SELECT 1 /*!90000 FOR UPDATE */;": "SELECT 1 /*!90000 FOR UPDATE */ /*application='api'*/;",
+	} {
+		if actual := commentDb.commentPrepare(query); actual != expected {
+			t.Errorf("%q: expected %q, got %q", query, expected, actual)
+		}
+	}
+}
+
+func TestCommentDB_CacheDB(t *testing.T) {
+	db, d := openFake()
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	tracer := mocktracer.New()
+	cacheDb := &CacheDB{DB: &CommentDB{DB: &s.BaseDB{DB: db}, Options: CommentOptions{
+		Tracer:          tracer,
+		Tags:            map[string]string{"application": "api"},
+		CommentPrepares: true,
+	}}}
+	for i := 0; i < 3; i++ {
+		span := tracer.StartSpan("request")
+		ctx := opentracing.ContextWithSpan(context.Background(), span)
+		if _, err := cacheDb.ExecContext(ctx, "UPDATE t SET a = 1"); err != nil {
+			t.Fatal(err)
+		}
+		span.Finish()
+	}
+	if prepares := atomic.LoadInt64(&d.prepares); prepares != 1 {
+		t.Fatalf("expected 1 prepare, got %d", prepares)
+	}
+	// The statement is commented with the static tags only.
+	expected := []string{
+		"UPDATE t SET a = 1 /*application='api'*/;",
+		"UPDATE t SET a = 1 /*application='api'*/;",
+		"UPDATE t SET a = 1 /*application='api'*/;",
+	}
+	if queries := d.executed(); !reflect.DeepEqual(queries, expected) {
+		t.Fatalf("expected %q, got %q", expected, queries)
+	}
+}
+
+func TestCommentDB_OverCacheDB(t *testing.T) {
+	db, d := openFake()
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	tracer := mocktracer.New()
+	cacheDb := &CacheDB{DB: &s.BaseDB{DB: db}}
+	commentDb := &CommentDB{DB: cacheDb, Options: CommentOptions{
+		Tracer: tracer,
+		Tags:   map[string]string{"application": "api"},
+	}}
+	for i := 0; i < 3; i++ {
+		span := tracer.StartSpan("request")
+		ctx := opentracing.ContextWithSpan(context.Background(), span)
+		ctx = WithCommentTags(ctx, map[string]string{"route": fmt.Sprintf("/users/%d", i)})
+		if _, err := commentDb.ExecContext(ctx, "UPDATE t SET a = 1"); err != nil {
+			t.Fatal(err)
+		}
+		span.Finish()
+	}
+	// The span and the tags in the context would make a statement per call.
+	if stats := cacheDb.CacheStats(); stats.Size != 1 || stats.Hits != 2 {
+		t.Fatalf("expected 1 cached statement and 2 hits, got %+v", stats)
+	}
+	expected := []string{
+		"UPDATE t SET a = 1 /*application='api'*/;",
+		"UPDATE t SET a = 1 /*application='api'*/;",
+		"UPDATE t SET a = 1 /*application='api'*/;",
+	}
+	if queries := d.executed(); !reflect.DeepEqual(queries, expected) {
+		t.Fatalf("expected %q, got %q", expected, queries)
+	}
+}
@@ -0,0 +1,170 @@
+package middleware
+
+import (
+	"context"
+	s "github.com/developerdong/sql"
+	"github.com/developerdong/sql/redact"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDriverMiddleware(t *testing.T) {
+	name, d := registerFake()
+	connector, err := s.OpenConnector(name, "", NewTraceDriverConn, NewCacheDriverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := s.OpenDB(connector)
+	defer func() {
+		_ = db.Close()
+	}()
+	db.SetMaxOpenConns(1)
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		var result string
+		if err := db.QueryRowContext(ctx, "SELECT ?", i).Scan(&result); err != nil {
+			t.Fatal(err)
+		}
+		if result != "SELECT ?" {
+			t.Fatalf("expected %q, got %q", "SELECT ?", result)
+		}
+	}
+	if prepares := atomic.LoadInt64(&d.prepares); prepares != 1 {
+		t.Fatalf("expected 1 prepare, got %d", prepares)
+	}
+	if spans := len(tracer.FinishedSpans()); spans != 3 {
+		t.Fatalf("expected 3 spans, got %d", spans)
+	}
+}
+
+func TestCacheDriver(t *testing.T) {
+	name, d := registerFake()
+	connector, err := s.OpenConnector(name, "", CacheDriver(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := s.OpenDB(connector)
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	for _, query := range []string{"UPDATE t SET a = ?", "UPDATE t SET a = ?", "UPDATE t SET b = ?", "UPDATE t SET a = ?"} {
+		if _, err := db.ExecContext(ctx, query, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The statement of a is evicted by b, and the statement of b by a.
+	if prepares, closes := atomic.LoadInt64(&d.prepares), atomic.LoadInt64(&d.closes); prepares != 3 || closes != 2 {
+		t.Fatalf("expected 3 prepares and 2 closes, got %d and %d", prepares, closes)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if closes := atomic.LoadInt64(&d.closes); closes != 3 {
+		t.Fatalf("expected all the statements to be closed, got %d closes", closes)
+	}
+}
+
+func TestTraceDriver(t *testing.T) {
+	name, _ := registerFake()
+	tracer := mocktracer.New()
+	connector, err := s.OpenConnector(name, "", TraceDriver(TraceOptions{
+		Tracer:   tracer,
+		SpanName: FingerprintSpanName,
+		DBType:   "mysql",
+		DSN:      "user:password@tcp(localhost:3306)/app",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := s.OpenDB(connector)
+	defer func() {
+		_ = db.Close()
+	}()
+	if _, err := db.ExecContext(context.Background(), "UPDATE t SET a = 1 WHERE b = ?", 1); err != nil {
+		t.Fatal(err)
+	}
+	spans := tracer.FinishedSpans()
+	if len(spans) == 0 {
+		t.Fatal("expected the spans of the tracer in the options")
+	}
+	span := spans[len(spans)-1]
+	if span.OperationName != "ExecContext update t set a = ? where b = ?" {
+		t.Fatalf("expected the fingerprint span name, got %q", span.OperationName)
+	}
+	expected := map[string]interface{}{
+		string(ext.SpanKind):    ext.SpanKindRPCClientEnum,
+		string(ext.DBType):      "mysql",
+		string(ext.DBInstance):  "app",
+		string(ext.DBUser):      "user",
+		string(ext.PeerAddress): "localhost:3306",
+		string(ext.DBStatement): "UPDATE t SET a = 1 WHERE b = ?",
+	}
+	if tags := span.Tags(); !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("expected %v, got %v", expected, tags)
+	}
+}
+
+func TestTraceDriver_Redact(t *testing.T) {
+	name, _ := registerFake()
+	tracer := mocktracer.New()
+	connector, err := s.OpenConnector(name, "", TraceDriver(TraceOptions{
+		Tracer: tracer,
+		Redact: &redact.Policy{MaskColumns: []string{"password"}},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := s.OpenDB(connector)
+	defer func() {
+		_ = db.Close()
+	}()
+	ctx := context.Background()
+	query := "UPDATE users SET password = ? WHERE id = ?"
+	if _, err := db.ExecContext(ctx, query, "secret", 1); err != nil {
+		t.Fatal(err)
+	}
+	if rows, err := db.QueryContext(ctx, query, "secret", 1); err != nil {
+		t.Fatal(err)
+	} else {
+		_ = rows.Close()
+	}
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = stmt.Close()
+	}()
+	if _, err := stmt.ExecContext(ctx, "secret", 1); err != nil {
+		t.Fatal(err)
+	}
+	if rows, err := stmt.QueryContext(ctx, "secret", 1); err != nil {
+		t.Fatal(err)
+	} else {
+		_ = rows.Close()
+	}
+	logged := 0
+	for _, span := range tracer.FinishedSpans() {
+		for _, record := range span.Logs() {
+			for _, field := range record.Fields {
+				if field.Key != "args" {
+					continue
+				}
+				logged++
+				if strings.Contains(field.ValueString, "secret") || !strings.Contains(field.ValueString, redact.DefaultMask) {
+					t.Errorf("%s: expected the password to be masked, got %s", span.OperationName, field.ValueString)
+				}
+			}
+		}
+	}
+	if logged != 4 {
+		t.Fatalf("expected the arguments of 4 calls to be logged, got %d", logged)
+	}
+}
@@ -0,0 +1,209 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fakeDriver is an in-memory driver for the tests which don't need a real
+// database. Every query returns a single row with a single column holding the
+// value returned by the value function, which is the query text by default,
+// and the error returned by the fail function, if any. The queries starting
+// with EMPTY return no rows.
+type fakeDriver struct {
+	mu       sync.Mutex
+	queries  []string
+	prepares int64
+	closes   int64
+	fail     func(query string) error
+	value    func(query string) driver.Value
+	// slowPrepare is the time to prepare the queries starting with SLOW.
+	slowPrepare time.Duration
+}
+
+// errBadPrepare is returned by preparing the queries starting with BAD.
+var errBadPrepare = errors.New("bad prepare")
+
+var fakeDriverSeq int64
+
+// registerFake registers a new fakeDriver and returns its name.
+func registerFake() (string, *fakeDriver) {
+	d := &fakeDriver{}
+	name := "fake" + strconv.FormatInt(atomic.AddInt64(&fakeDriverSeq, 1), 10)
+	sql.Register(name, d)
+	return name, d
+}
+
+// openFake registers a new fakeDriver and opens a database with it.
+func openFake() (*sql.DB, *fakeDriver) {
+	name, d := registerFake()
+	db, err := sql.Open(name, "")
+	if err != nil {
+		panic(err)
+	}
+	return db, d
+}
+
+func (d *fakeDriver) record(query string) error {
+	d.mu.Lock()
+	d.queries = append(d.queries, query)
+	fail := d.fail
+	d.mu.Unlock()
+	if fail != nil {
+		return fail(query)
+	}
+	return nil
+}
+
+func (d *fakeDriver) executed() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.queries...)
+}
+
+func (d *fakeDriver) setValue(value func(query string) driver.Value) {
+	d.mu.Lock()
+	d.value = value
+	d.mu.Unlock()
+}
+
+func (d *fakeDriver) rows(query string) driver.Rows {
+	if strings.HasPrefix(query, "EMPTY") {
+		return &fakeRows{done: true}
+	}
+	d.mu.Lock()
+	value := d.value
+	d.mu.Unlock()
+	if value != nil {
+		return &fakeRows{value: value(query)}
+	}
+	return &fakeRows{value: query}
+}
+
+func (d *fakeDriver) setFail(fail func(query string) error) {
+	d.mu.Lock()
+	d.fail = fail
+	d.mu.Unlock()
+}
+
+func (d *fakeDriver) Open(string) (driver.Conn, error) {
+	return &fakeConn{d}, nil
+}
+
+type fakeConn struct {
+	d *fakeDriver
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	atomic.AddInt64(&c.d.prepares, 1)
+	if strings.HasPrefix(query, "SLOW") {
+		time.Sleep(c.d.slowPrepare)
+	}
+	if strings.HasPrefix(query, "BAD") {
+		return nil, errBadPrepare
+	}
+	return &fakeStmt{c.d, query}, nil
+}
+
+func (c *fakeConn) Ping(context.Context) error {
+	return c.d.record("PING")
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	if err := c.d.record("BEGIN"); err != nil {
+		return nil, err
+	}
+	return &fakeTx{c.d}, nil
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	if err := c.d.record(query); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	if err := c.d.record(query); err != nil {
+		return nil, err
+	}
+	return c.d.rows(query), nil
+}
+
+type fakeStmt struct {
+	d     *fakeDriver
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	atomic.AddInt64(&s.d.closes, 1)
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	if err := s.d.record(s.query); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	if err := s.d.record(s.query); err != nil {
+		return nil, err
+	}
+	return s.d.rows(s.query), nil
+}
+
+type fakeTx struct {
+	d *fakeDriver
+}
+
+func (t *fakeTx) Commit() error {
+	return t.d.record("COMMIT")
+}
+
+func (t *fakeTx) Rollback() error {
+	return t.d.record("ROLLBACK")
+}
+
+type fakeRows struct {
+	value driver.Value
+	done  bool
+}
+
+func (r *fakeRows) Columns() []string {
+	return []string{"query"}
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = r.value
+	return nil
+}
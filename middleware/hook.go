@@ -0,0 +1,391 @@
+package middleware
+
+import (
+	"context"
+	stdSql "database/sql"
+	"github.com/developerdong/sql"
+	"time"
+)
+
+var (
+	_ sql.DB   = (*HookDB)(nil)
+	_ sql.Stmt = (*HookStmt)(nil)
+	_ sql.Tx   = (*HookTx)(nil)
+	_ sql.Conn = (*HookConn)(nil)
+)
+
+// Operation is the kind of the operation seen by the hooks.
+type Operation string
+
+const (
+	OpPing     Operation = "Ping"
+	OpPrepare  Operation = "Prepare"
+	OpExec     Operation = "Exec"
+	OpQuery    Operation = "Query"
+	OpQueryRow Operation = "QueryRow"
+	OpBegin    Operation = "Begin"
+	OpCommit   Operation = "Commit"
+	OpRollback Operation = "Rollback"
+	OpConn     Operation = "Conn"
+	OpClose    Operation = "Close"
+)
+
+// HookEvent describes an operation. Op, Query, Args and Start are filled before
+// the Before hook, while Duration, Result and Err are filled before the After
+// hook.
+type HookEvent struct {
+	Op    Operation
+	Query string
+	Args  []interface{}
+	Start time.Time
+	// Duration is the time spent by the operation.
+	Duration time.Duration
+	// Result is the first returned value of the operation, such as a
+	// sql.Result, a sql.Stmt or a sql.Tx. It is nil if the operation
+	// returns nothing but an error.
+	Result interface{}
+	Err    error
+}
+
+// Hooks are the callbacks around every operation of a HookDB and the objects
+// created by it. Both of them are optional.
+type Hooks struct {
+	// Before is called before the operation. The returned context, if not
+	// nil, is passed to the operation and the After hook.
+	Before func(ctx context.Context, e *HookEvent) context.Context
+	// After is called after the operation.
+	After func(ctx context.Context, e *HookEvent)
+}
+
+func (h Hooks) run(ctx context.Context, op Operation, query string, args []interface{}, f func(ctx context.Context) (interface{}, error)) error {
+	e := &HookEvent{Op: op, Query: query, Args: args, Start: time.Now()}
+	if h.Before != nil {
+		if c := h.Before(ctx, e); c != nil {
+			ctx = c
+		}
+	}
+	e.Result, e.Err = f(ctx)
+	e.Duration = time.Since(e.Start)
+	if h.After != nil {
+		h.After(ctx, e)
+	}
+	return e.Err
+}
+
+// HookDB calls the hooks around every operation, including the ones of the
+// Stmt, Tx and Conn created by it. The context-less methods are routed to the
+// context variants with context.Background().
+type HookDB struct {
+	sql.DB
+	Hooks Hooks
+}
+
+// Hook returns a middleware which wraps the DB with a HookDB.
+func Hook(hooks Hooks) sql.Middleware {
+	return func(db sql.DB) sql.DB {
+		return &HookDB{DB: db, Hooks: hooks}
+	}
+}
+
+// Unwrap returns the wrapped DB.
+func (h *HookDB) Unwrap() sql.DB {
+	return h.DB
+}
+
+func (h *HookDB) PingContext(ctx context.Context) error {
+	return h.Hooks.run(ctx, OpPing, "", nil, func(ctx context.Context) (interface{}, error) {
+		return nil, h.DB.PingContext(ctx)
+	})
+}
+
+func (h *HookDB) Ping() error {
+	return h.PingContext(context.Background())
+}
+
+func (h *HookDB) Close() error {
+	return h.Hooks.run(context.Background(), OpClose, "", nil, func(ctx context.Context) (interface{}, error) {
+		return nil, h.DB.Close()
+	})
+}
+
+func (h *HookDB) PrepareContext(ctx context.Context, query string) (sql.Stmt, error) {
+	var stmt sql.Stmt
+	err := h.Hooks.run(ctx, OpPrepare, query, nil, func(ctx context.Context) (r interface{}, err error) {
+		stmt, err = h.DB.PrepareContext(ctx, query)
+		return stmt, err
+	})
+	return &HookStmt{stmt, h.Hooks, query}, err
+}
+
+func (h *HookDB) Prepare(query string) (sql.Stmt, error) {
+	return h.PrepareContext(context.Background(), query)
+}
+
+func (h *HookDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	var result sql.Result
+	err := h.Hooks.run(ctx, OpExec, query, args, func(ctx context.Context) (r interface{}, err error) {
+		result, err = h.DB.ExecContext(ctx, query, args...)
+		return result, err
+	})
+	return result, err
+}
+
+func (h *HookDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return h.ExecContext(context.Background(), query, args...)
+}
+
+func (h *HookDB) QueryContext(ctx context.Context, query string, args ...interface{}) (sql.Rows, error) {
+	var rows sql.Rows
+	err := h.Hooks.run(ctx, OpQuery, query, args, func(ctx context.Context) (r interface{}, err error) {
+		rows, err = h.DB.QueryContext(ctx, query, args...)
+		return rows, err
+	})
+	return rows, err
+}
+
+func (h *HookDB) Query(query string, args ...interface{}) (sql.Rows, error) {
+	return h.QueryContext(context.Background(), query, args...)
+}
+
+func (h *HookDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) sql.Row {
+	var row sql.Row
+	_ = h.Hooks.run(ctx, OpQueryRow, query, args, func(ctx context.Context) (interface{}, error) {
+		row = h.DB.QueryRowContext(ctx, query, args...)
+		return row, row.Err()
+	})
+	return row
+}
+
+func (h *HookDB) QueryRow(query string, args ...interface{}) sql.Row {
+	return h.QueryRowContext(context.Background(), query, args...)
+}
+
+func (h *HookDB) BeginTx(ctx context.Context, opts *stdSql.TxOptions) (sql.Tx, error) {
+	var tx sql.Tx
+	err := h.Hooks.run(ctx, OpBegin, "", nil, func(ctx context.Context) (r interface{}, err error) {
+		tx, err = h.DB.BeginTx(ctx, opts)
+		return tx, err
+	})
+	return &HookTx{tx, h.Hooks}, err
+}
+
+func (h *HookDB) Begin() (sql.Tx, error) {
+	return h.BeginTx(context.Background(), nil)
+}
+
+func (h *HookDB) Conn(ctx context.Context) (sql.Conn, error) {
+	var conn sql.Conn
+	err := h.Hooks.run(ctx, OpConn, "", nil, func(ctx context.Context) (r interface{}, err error) {
+		conn, err = h.DB.Conn(ctx)
+		return conn, err
+	})
+	return &HookConn{conn, h.Hooks}, err
+}
+
+// HookStmt calls the hooks around every operation of the statement.
+type HookStmt struct {
+	sql.Stmt
+	hooks Hooks
+	query string
+}
+
+// Unwrap returns the wrapped Stmt.
+func (s *HookStmt) Unwrap() sql.Stmt {
+	return s.Stmt
+}
+
+func (s *HookStmt) ExecContext(ctx context.Context, args ...interface{}) (sql.Result, error) {
+	var result sql.Result
+	err := s.hooks.run(ctx, OpExec, s.query, args, func(ctx context.Context) (r interface{}, err error) {
+		result, err = s.Stmt.ExecContext(ctx, args...)
+		return result, err
+	})
+	return result, err
+}
+
+func (s *HookStmt) Exec(args ...interface{}) (sql.Result, error) {
+	return s.ExecContext(context.Background(), args...)
+}
+
+func (s *HookStmt) QueryContext(ctx context.Context, args ...interface{}) (sql.Rows, error) {
+	var rows sql.Rows
+	err := s.hooks.run(ctx, OpQuery, s.query, args, func(ctx context.Context) (r interface{}, err error) {
+		rows, err = s.Stmt.QueryContext(ctx, args...)
+		return rows, err
+	})
+	return rows, err
+}
+
+func (s *HookStmt) Query(args ...interface{}) (sql.Rows, error) {
+	return s.QueryContext(context.Background(), args...)
+}
+
+func (s *HookStmt) QueryRowContext(ctx context.Context, args ...interface{}) sql.Row {
+	var row sql.Row
+	_ = s.hooks.run(ctx, OpQueryRow, s.query, args, func(ctx context.Context) (interface{}, error) {
+		row = s.Stmt.QueryRowContext(ctx, args...)
+		return row, row.Err()
+	})
+	return row
+}
+
+func (s *HookStmt) QueryRow(args ...interface{}) sql.Row {
+	return s.QueryRowContext(context.Background(), args...)
+}
+
+func (s *HookStmt) Close() error {
+	return s.hooks.run(context.Background(), OpClose, s.query, nil, func(ctx context.Context) (interface{}, error) {
+		return nil, s.Stmt.Close()
+	})
+}
+
+// HookTx calls the hooks around every operation of the transaction.
+type HookTx struct {
+	sql.Tx
+	hooks Hooks
+}
+
+// Unwrap returns the wrapped Tx.
+func (t *HookTx) Unwrap() sql.Tx {
+	return t.Tx
+}
+
+func (t *HookTx) Commit() error {
+	return t.hooks.run(context.Background(), OpCommit, "", nil, func(ctx context.Context) (interface{}, error) {
+		return nil, t.Tx.Commit()
+	})
+}
+
+func (t *HookTx) Rollback() error {
+	return t.hooks.run(context.Background(), OpRollback, "", nil, func(ctx context.Context) (interface{}, error) {
+		return nil, t.Tx.Rollback()
+	})
+}
+
+func (t *HookTx) PrepareContext(ctx context.Context, query string) (sql.Stmt, error) {
+	var stmt sql.Stmt
+	err := t.hooks.run(ctx, OpPrepare, query, nil, func(ctx context.Context) (r interface{}, err error) {
+		stmt, err = t.Tx.PrepareContext(ctx, query)
+		return stmt, err
+	})
+	return &HookStmt{stmt, t.hooks, query}, err
+}
+
+func (t *HookTx) Prepare(query string) (sql.Stmt, error) {
+	return t.PrepareContext(context.Background(), query)
+}
+
+func (t *HookTx) StmtContext(ctx context.Context, stmt sql.Stmt) sql.Stmt {
+	return &HookStmt{t.Tx.StmtContext(ctx, stmt), t.hooks, sql.QueryString(stmt)}
+}
+
+func (t *HookTx) Stmt(stmt sql.Stmt) sql.Stmt {
+	return t.StmtContext(context.Background(), stmt)
+}
+
+func (t *HookTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	var result sql.Result
+	err := t.hooks.run(ctx, OpExec, query, args, func(ctx context.Context) (r interface{}, err error) {
+		result, err = t.Tx.ExecContext(ctx, query, args...)
+		return result, err
+	})
+	return result, err
+}
+
+func (t *HookTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return t.ExecContext(context.Background(), query, args...)
+}
+
+func (t *HookTx) QueryContext(ctx context.Context, query string, args ...interface{}) (sql.Rows, error) {
+	var rows sql.Rows
+	err := t.hooks.run(ctx, OpQuery, query, args, func(ctx context.Context) (r interface{}, err error) {
+		rows, err = t.Tx.QueryContext(ctx, query, args...)
+		return rows, err
+	})
+	return rows, err
+}
+
+func (t *HookTx) Query(query string, args ...interface{}) (sql.Rows, error) {
+	return t.QueryContext(context.Background(), query, args...)
+}
+
+func (t *HookTx) QueryRowContext(ctx context.Context, query string, args ...interface{}) sql.Row {
+	var row sql.Row
+	_ = t.hooks.run(ctx, OpQueryRow, query, args, func(ctx context.Context) (interface{}, error) {
+		row = t.Tx.QueryRowContext(ctx, query, args...)
+		return row, row.Err()
+	})
+	return row
+}
+
+func (t *HookTx) QueryRow(query string, args ...interface{}) sql.Row {
+	return t.QueryRowContext(context.Background(), query, args...)
+}
+
+// HookConn calls the hooks around every operation of the connection.
+type HookConn struct {
+	sql.Conn
+	hooks Hooks
+}
+
+// Unwrap returns the wrapped Conn.
+func (c *HookConn) Unwrap() sql.Conn {
+	return c.Conn
+}
+
+func (c *HookConn) PingContext(ctx context.Context) error {
+	return c.hooks.run(ctx, OpPing, "", nil, func(ctx context.Context) (interface{}, error) {
+		return nil, c.Conn.PingContext(ctx)
+	})
+}
+
+func (c *HookConn) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	var result sql.Result
+	err := c.hooks.run(ctx, OpExec, query, args, func(ctx context.Context) (r interface{}, err error) {
+		result, err = c.Conn.ExecContext(ctx, query, args...)
+		return result, err
+	})
+	return result, err
+}
+
+func (c *HookConn) QueryContext(ctx context.Context, query string, args ...interface{}) (sql.Rows, error) {
+	var rows sql.Rows
+	err := c.hooks.run(ctx, OpQuery, query, args, func(ctx context.Context) (r interface{}, err error) {
+		rows, err = c.Conn.QueryContext(ctx, query, args...)
+		return rows, err
+	})
+	return rows, err
+}
+
+func (c *HookConn) QueryRowContext(ctx context.Context, query string, args ...interface{}) sql.Row {
+	var row sql.Row
+	_ = c.hooks.run(ctx, OpQueryRow, query, args, func(ctx context.Context) (interface{}, error) {
+		row = c.Conn.QueryRowContext(ctx, query, args...)
+		return row, row.Err()
+	})
+	return row
+}
+
+func (c *HookConn) PrepareContext(ctx context.Context, query string) (sql.Stmt, error) {
+	var stmt sql.Stmt
+	err := c.hooks.run(ctx, OpPrepare, query, nil, func(ctx context.Context) (r interface{}, err error) {
+		stmt, err = c.Conn.PrepareContext(ctx, query)
+		return stmt, err
+	})
+	return &HookStmt{stmt, c.hooks, query}, err
+}
+
+func (c *HookConn) BeginTx(ctx context.Context, opts *stdSql.TxOptions) (sql.Tx, error) {
+	var tx sql.Tx
+	err := c.hooks.run(ctx, OpBegin, "", nil, func(ctx context.Context) (r interface{}, err error) {
+		tx, err = c.Conn.BeginTx(ctx, opts)
+		return tx, err
+	})
+	return &HookTx{tx, c.hooks}, err
+}
+
+func (c *HookConn) Close() error {
+	return c.hooks.run(context.Background(), OpClose, "", nil, func(ctx context.Context) (interface{}, error) {
+		return nil, c.Conn.Close()
+	})
+}
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	s "github.com/developerdong/sql"
+	"reflect"
+	"testing"
+)
+
+func TestHookDB(t *testing.T) {
+	db, d := openFake()
+	defer func() {
+		_ = db.Close()
+	}()
+	var before, after []Operation
+	var failed error
+	hookDb := s.Chain(&s.BaseDB{DB: db}, Hook(Hooks{
+		Before: func(ctx context.Context, e *HookEvent) context.Context {
+			before = append(before, e.Op)
+			return nil
+		},
+		After: func(ctx context.Context, e *HookEvent) {
+			after = append(after, e.Op)
+			if e.Err != nil {
+				failed = e.Err
+			}
+		},
+	}))
+	ctx := context.Background()
+	if _, err := hookDb.ExecContext(ctx, "UPDATE t SET a = 1"); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := hookDb.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := tx.PrepareContext(ctx, "SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result string
+	if err := stmt.QueryRowContext(ctx).Scan(&result); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Operation{OpExec, OpBegin, OpPrepare, OpQueryRow, OpCommit}
+	if !reflect.DeepEqual(before, expected) || !reflect.DeepEqual(after, expected) {
+		t.Fatalf("expected %v, got %v and %v", expected, before, after)
+	}
+	if failed != nil {
+		t.Fatal(failed)
+	}
+	errFake := errors.New("fake")
+	d.setFail(func(string) error { return errFake })
+	if _, err := hookDb.Exec("UPDATE t SET a = 1"); !errors.Is(err, errFake) {
+		t.Fatalf("expected %v, got %v", errFake, err)
+	}
+	if !errors.Is(failed, errFake) {
+		t.Fatalf("expected the After hook to see %v, got %v", errFake, failed)
+	}
+}
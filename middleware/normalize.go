@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"github.com/developerdong/sql/sqlparse"
+	"strings"
+)
+
+// NormalizeSpaces collapses the whitespace of the query outside the string
+// literals, quoted identifiers and comments into single spaces, and trims the
+// leading and trailing whitespace. The line comments are kept with their
+// terminating newlines, so the query means the same.
+func NormalizeSpaces(query string) string {
+	return normalizeQuery(query, false)
+}
+
+// StripComments is NormalizeSpaces which also strips the comments, except the
+// executable comments /*! ... */ and the optimizer hints /*+ ... */ which
+// change the meaning of the query.
+func StripComments(query string) string {
+	return normalizeQuery(query, true)
+}
+
+// normalizeQuery rewrites the query token by token with sqlparse. The text
+// between the tokens is whitespace or the markers of the executable comments,
+// which are kept.
+func normalizeQuery(query string, stripComments bool) string {
+	var b strings.Builder
+	b.Grow(len(query))
+	space := false
+	// dashes is the number of the adjacent minus signs at the end.
+	dashes := 0
+	// write writes the text, preceded by a space if there is whitespace or a
+	// stripped comment before it. The space is dropped after the adjacent
+	// minus signs, where it would start a comment.
+	write := func(text string) {
+		if space && b.Len() > 0 && dashes < 2 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteString(text)
+	}
+	t := sqlparse.NewTokenizer(query)
+	end := 0
+	for {
+		token := t.Next()
+		for gap := query[end:token.Pos]; gap != ""; {
+			i := 0
+			for i < len(gap) && sqlparse.IsSpace(gap[i]) {
+				i++
+			}
+			if i > 0 {
+				space = true
+			} else {
+				for i < len(gap) && !sqlparse.IsSpace(gap[i]) {
+					i++
+				}
+				write(gap[:i])
+				dashes = 0
+			}
+			gap = gap[i:]
+		}
+		if token.Type == sqlparse.EOF {
+			break
+		}
+		end = token.Pos + len(token.Text)
+		switch {
+		case token.Type != sqlparse.Comment:
+			n := b.Len()
+			write(token.Text)
+			if !token.IsSymbol("-") {
+				dashes = 0
+			} else if b.Len()-n == 1 {
+				dashes++
+			} else {
+				dashes = 1
+			}
+		case stripComments && !strings.HasPrefix(token.Text, "/*+"):
+			space = true
+		default:
+			write(token.Text)
+			dashes = 0
+			if end < len(query) && !strings.HasPrefix(token.Text, "/*") {
+				// The newline ending the line comment is written, so the
+				// whitespace after it is skipped.
+				b.WriteByte('\n')
+				for end < len(query) && sqlparse.IsSpace(query[end]) {
+					end++
+				}
+			}
+		}
+	}
+	normalized := b.String()
+	if dashes > 1 {
+		// The adjacent minus signs at the end, which are left by a stripped
+		// comment, would start a comment, so they are separated.
+		normalized = normalized[:len(normalized)-dashes] + strings.Repeat("- ", dashes-1) + "-"
+	}
+	return normalized
+}
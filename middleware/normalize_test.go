@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"testing"
+)
+
+func TestNormalizeSpaces(t *testing.T) {
+	for query, expected := range map[string]string{
+		"  SELECT\t1\n\n FROM  t  ":                  "SELECT 1 FROM t",
+		"SELECT 'a  b', \"c\\\"  d\", `e  f` FROM t": "SELECT 'a  b', \"c\\\"  d\", `e  f` FROM t",
+		"SELECT 'it''s  ok'":                         "SELECT 'it''s  ok'",
+		"SELECT 1 -- one  two\n  FROM t":             "SELECT 1 -- one  two\nFROM t",
+		"SELECT 1 # one\n FROM t":                    "SELECT 1 # one\nFROM t",
+		"SELECT 1 /* a  b */  FROM t":                "SELECT 1 /* a  b */ FROM t",
+		"SELECT 2--1":                                "SELECT 2--1",
+		"SELECT 'unterminated  ":                     "SELECT 'unterminated  ",
+	} {
+		if normalized := NormalizeSpaces(query); normalized != expected {
+			t.Errorf("NormalizeSpaces(%q): expected %q, got %q", query, expected, normalized)
+		}
+		if normalized := NormalizeSpaces(expected); normalized != expected {
+			t.Errorf("NormalizeSpaces(%q) is not idempotent: got %q", expected, normalized)
+		}
+	}
+}
+
+func TestStripComments(t *testing.T) {
+	for query, expected := range map[string]string{
+		"/* caller */ SELECT 1 FROM t /* caller */":  "SELECT 1 FROM t",
+		"SELECT/**/1 -- one\nFROM t # two":           "SELECT 1 FROM t",
+		"SELECT /*+ MAX_EXECUTION_TIME(1) */ 1":      "SELECT /*+ MAX_EXECUTION_TIME(1) */ 1",
+		"SELECT /*!50000 SQL_NO_CACHE */ 1":          "SELECT /*!50000 SQL_NO_CACHE */ 1",
+		"SELECT '/* a */', `-- b` FROM t":            "SELECT '/* a */', `-- b` FROM t",
+		"SELECT /*!50000 SQL_NO_CACHE  1 */  FROM t": "SELECT /*!50000 SQL_NO_CACHE 1 */ FROM t",
+		// The stripped comments never leave a double dash followed by
+		// whitespace, which would start a comment.
+		"SELECT 5--/* c */ 1": "SELECT 5--1",
+		"SELECT 5--#x\n1":     "SELECT 5--1",
+		"SELECT 5-/* c */-1":  "SELECT 5- -1",
+		"E--#..":              "E- -",
+		"E--/* c */":          "E- -",
+		"SELECT 5//* c */*2":  "SELECT 5/ *2",
+		"SELECT !---#":        "SELECT !- - -",
+	} {
+		if normalized := StripComments(query); normalized != expected {
+			t.Errorf("StripComments(%q): expected %q, got %q", query, expected, normalized)
+		}
+		if normalized := StripComments(expected); normalized != expected {
+			t.Errorf("StripComments(%q) is not idempotent: got %q", expected, normalized)
+		}
+	}
+}
+
+func BenchmarkNormalizeSpaces(b *testing.B) {
+	query := "SELECT id, name\n  FROM users\n WHERE name = 'a  b' /* caller */\n   AND id IN (?, ?, ?)"
+	for i := 0; i < b.N; i++ {
+		NormalizeSpaces(query)
+	}
+}
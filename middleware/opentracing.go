@@ -4,9 +4,16 @@ import (
 	"context"
 	stdSql "database/sql"
 	"database/sql/driver"
+	"errors"
 	"github.com/developerdong/sql"
+	"github.com/developerdong/sql/fingerprint"
+	"github.com/developerdong/sql/redact"
+	"github.com/go-sql-driver/mysql"
 	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 	"github.com/opentracing/opentracing-go/log"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,403 +22,809 @@ var (
 	_ sql.Stmt = (*TraceStmt)(nil)
 	_ sql.Tx   = (*TraceTx)(nil)
 	_ sql.Conn = (*TraceConn)(nil)
+	_ sql.Rows = (*TraceRows)(nil)
+	_ sql.Row  = (*TraceRow)(nil)
 )
 
+// The tags set by TraceDB in addition to the standard ones.
+const (
+	// TagRowsFetched is the number of the rows fetched by a query.
+	TagRowsFetched = "db.rows_fetched"
+	// TagNoRows is set to true if a QueryRow finds no rows, which is not
+	// tagged as an error.
+	TagNoRows = "db.no_rows"
+	// TagIsolationLevel is the isolation level of a transaction span.
+	TagIsolationLevel = "db.isolation_level"
+	// TagReadOnly is whether a transaction span is read-only.
+	TagReadOnly = "db.read_only"
+)
+
+// DefaultTraceDBType is the db.type tag of TraceDB if DBType is empty.
+const DefaultTraceDBType = "sql"
+
+// TraceOptions are the options of a TraceDB.
+type TraceOptions struct {
+	// Tracer starts the spans. opentracing.GlobalTracer() is used if it is nil,
+	// which is got at every call, so a tracer set later takes effect.
+	Tracer opentracing.Tracer
+	// SpanName returns the name of the span of the operation on the query,
+	// e.g. FingerprintSpanName. The operation, such as "QueryContext", is
+	// used if it is nil. The query is empty for the operations without one.
+	SpanName func(operation, query string) string
+	// DBType is the db.type tag, DefaultTraceDBType if it is empty.
+	DBType string
+	// Redact redacts the arguments logged in the spans. The arguments are
+	// logged verbatim if it is nil.
+	Redact *redact.Policy
+	// DSN is the data source name of the MySQL driver, from which the
+	// db.instance, db.user and peer.address tags are parsed. These tags are
+	// not set if it is empty or invalid. The password is never tagged.
+	DSN string
+	// SkipConfigSpans disables the spans of the configuration and
+	// introspection methods, which are SetMaxIdleConns, SetMaxOpenConns,
+	// SetConnMaxLifetime, SetConnMaxIdleTime, Stats and Driver.
+	SkipConfigSpans bool
+	// RouteContextless routes the context-less methods, such as Exec and
+	// Query, to their context variants with the context returned by
+	// FallbackContext, so their spans join the trace in it instead of
+	// starting new traces.
+	RouteContextless bool
+	// FallbackContext returns the context of the context-less methods routed
+	// by RouteContextless. context.Background() is used if it is nil or
+	// returns nil.
+	FallbackContext func() context.Context
+}
+
+// TraceDB traces the calls to the DB with opentracing. The spans follow the
+// semantic conventions of opentracing: they are client spans tagged with the
+// database and the statement, and are marked with the error tag on failure.
 type TraceDB struct {
 	sql.DB
+	Options TraceOptions
+
+	once sync.Once
+	tags opentracing.Tags
+}
+
+// NewTraceDB wraps the DB with a TraceDB. It fits the sql.Middleware type.
+func NewTraceDB(db sql.DB) sql.DB {
+	return &TraceDB{DB: db}
+}
+
+// Trace returns a middleware which wraps the DB with a TraceDB.
+func Trace(opts TraceOptions) sql.Middleware {
+	return func(db sql.DB) sql.DB {
+		return &TraceDB{DB: db, Options: opts}
+	}
+}
+
+// Unwrap returns the wrapped DB.
+func (t *TraceDB) Unwrap() sql.DB {
+	return t.DB
+}
+
+// FingerprintSpanName names the span by the operation and the fingerprint of
+// the query. It fits the SpanName field of TraceOptions.
+func FingerprintSpanName(operation, query string) string {
+	if query == "" {
+		return operation
+	}
+	return operation + " " + fingerprint.Normalize(query)
+}
+
+// defaultTraceTags are the tags of the spans without a TraceDB.
+var defaultTraceTags = opentracing.Tags{string(ext.DBType): DefaultTraceDBType}
+
+// getTags returns the tags of all the spans, which are computed at the first
+// use.
+func (t *TraceDB) getTags() opentracing.Tags {
+	t.once.Do(func() {
+		dbType := t.Options.DBType
+		if dbType == "" {
+			dbType = DefaultTraceDBType
+		}
+		t.tags = opentracing.Tags{string(ext.DBType): dbType}
+		if t.Options.DSN == "" {
+			return
+		}
+		cfg, err := mysql.ParseDSN(t.Options.DSN)
+		if err != nil {
+			return
+		}
+		if cfg.DBName != "" {
+			t.tags[string(ext.DBInstance)] = cfg.DBName
+		}
+		if cfg.User != "" {
+			t.tags[string(ext.DBUser)] = cfg.User
+		}
+		if cfg.Addr != "" {
+			t.tags[string(ext.PeerAddress)] = cfg.Addr
+		}
+	})
+	return t.tags
+}
+
+// redact returns the arguments of the query to be logged.
+func (t *TraceDB) redact(query string, args []interface{}) []interface{} {
+	if t == nil {
+		return args
+	}
+	return t.Options.Redact.Redact(query, args)
+}
+
+// startSpan starts a client span of the operation on the query as a child of
+// the span in the context, and returns a context with the new span. The query
+// may be empty. The TraceDB may be nil for the wrappers created without it.
+func (t *TraceDB) startSpan(ctx context.Context, operation, query string) (opentracing.Span, context.Context) {
+	tracer := opentracing.GlobalTracer()
+	name := operation
+	tags := defaultTraceTags
+	if t != nil {
+		if t.Options.Tracer != nil {
+			tracer = t.Options.Tracer
+		}
+		if t.Options.SpanName != nil {
+			name = t.Options.SpanName(operation, query)
+		}
+		tags = t.getTags()
+	}
+	span, ctx := opentracing.StartSpanFromContextWithTracer(ctx, tracer, name, ext.SpanKindRPCClient, tags)
+	if query != "" {
+		ext.DBStatement.Set(span, query)
+	}
+	return span, ctx
+}
+
+// fallback returns the context of the context-less methods and whether they
+// are routed to the context variants.
+func (t *TraceDB) fallback() (context.Context, bool) {
+	if t == nil || !t.Options.RouteContextless {
+		return nil, false
+	}
+	if t.Options.FallbackContext != nil {
+		if ctx := t.Options.FallbackContext(); ctx != nil {
+			return ctx, true
+		}
+	}
+	return context.Background(), true
 }
 
 func (t *TraceDB) PingContext(ctx context.Context) error {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "PingContext")
+	span, ctx := t.startSpan(ctx, "PingContext", "")
 	defer span.Finish()
 	err := t.DB.PingContext(ctx)
 	if err != nil {
+		ext.Error.Set(span, true)
 		span.LogFields(log.Event("error"), log.Error(err))
 	}
 	return err
 }
 
 func (t *TraceDB) Ping() error {
-	span := opentracing.StartSpan("Ping")
+	if ctx, ok := t.fallback(); ok {
+		return t.PingContext(ctx)
+	}
+	span, _ := t.startSpan(context.Background(), "Ping", "")
 	defer span.Finish()
 	err := t.DB.Ping()
 	if err != nil {
+		ext.Error.Set(span, true)
 		span.LogFields(log.Event("error"), log.Error(err))
 	}
 	return err
 }
 
 func (t *TraceDB) Close() error {
-	span := opentracing.StartSpan("Close")
+	span, _ := t.startSpan(context.Background(), "Close", "")
 	defer span.Finish()
 	err := t.DB.Close()
 	if err != nil {
+		ext.Error.Set(span, true)
 		span.LogFields(log.Event("error"), log.Error(err))
 	}
 	return err
 }
 
 func (t *TraceDB) SetMaxIdleConns(n int) {
-	span := opentracing.StartSpan("SetMaxIdleConns")
+	if t.Options.SkipConfigSpans {
+		t.DB.SetMaxIdleConns(n)
+		return
+	}
+	span, _ := t.startSpan(context.Background(), "SetMaxIdleConns", "")
 	defer span.Finish()
 	span.LogFields(log.Event("debug"), log.Int("n", n))
 	t.DB.SetMaxIdleConns(n)
 }
 
 func (t *TraceDB) SetMaxOpenConns(n int) {
-	span := opentracing.StartSpan("SetMaxOpenConns")
+	if t.Options.SkipConfigSpans {
+		t.DB.SetMaxOpenConns(n)
+		return
+	}
+	span, _ := t.startSpan(context.Background(), "SetMaxOpenConns", "")
 	defer span.Finish()
 	span.LogFields(log.Event("debug"), log.Int("n", n))
 	t.DB.SetMaxOpenConns(n)
 }
 
 func (t *TraceDB) SetConnMaxLifetime(d time.Duration) {
-	span := opentracing.StartSpan("SetConnMaxLifetime")
+	if t.Options.SkipConfigSpans {
+		t.DB.SetConnMaxLifetime(d)
+		return
+	}
+	span, _ := t.startSpan(context.Background(), "SetConnMaxLifetime", "")
 	defer span.Finish()
 	span.LogFields(log.Event("debug"), log.String("d", d.String()))
 	t.DB.SetConnMaxLifetime(d)
 }
 
 func (t *TraceDB) SetConnMaxIdleTime(d time.Duration) {
-	span := opentracing.StartSpan("SetConnMaxIdleTime")
+	if t.Options.SkipConfigSpans {
+		t.DB.SetConnMaxIdleTime(d)
+		return
+	}
+	span, _ := t.startSpan(context.Background(), "SetConnMaxIdleTime", "")
 	defer span.Finish()
 	span.LogFields(log.Event("debug"), log.String("d", d.String()))
 	t.DB.SetConnMaxIdleTime(d)
 }
 
 func (t *TraceDB) Stats() stdSql.DBStats {
-	span := opentracing.StartSpan("Stats")
+	if t.Options.SkipConfigSpans {
+		return t.DB.Stats()
+	}
+	span, _ := t.startSpan(context.Background(), "Stats", "")
 	defer span.Finish()
 	return t.DB.Stats()
 }
 
 func (t *TraceDB) PrepareContext(ctx context.Context, query string) (sql.Stmt, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "PrepareContext")
+	span, ctx := t.startSpan(ctx, "PrepareContext", query)
 	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", query))
 	stmt, err := t.DB.PrepareContext(ctx, query)
 	if err != nil {
+		ext.Error.Set(span, true)
 		span.LogFields(log.Event("error"), log.Error(err))
 	}
-	return &TraceStmt{stmt, query}, err
+	return &TraceStmt{stmt, query, t, nil}, err
 }
 
 func (t *TraceDB) Prepare(query string) (sql.Stmt, error) {
-	span := opentracing.StartSpan("Prepare")
+	if ctx, ok := t.fallback(); ok {
+		return t.PrepareContext(ctx, query)
+	}
+	span, _ := t.startSpan(context.Background(), "Prepare", query)
 	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", query))
 	stmt, err := t.DB.Prepare(query)
 	if err != nil {
+		ext.Error.Set(span, true)
 		span.LogFields(log.Event("error"), log.Error(err))
 	}
-	return &TraceStmt{stmt, query}, err
+	return &TraceStmt{stmt, query, t, nil}, err
 }
 
-func (t *TraceDB) ExecContext(ctx context.Context, query string, args ...interface{}) (stdSql.Result, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "ExecContext")
+func (t *TraceDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	span, ctx := t.startSpan(ctx, "ExecContext", query)
 	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", query), log.Object("args", args))
+	span.LogFields(log.Event("debug"), log.Object("args", t.redact(query, args)))
 	result, err := t.DB.ExecContext(ctx, query, args...)
 	if err != nil {
+		ext.Error.Set(span, true)
 		span.LogFields(log.Event("error"), log.Error(err))
 	}
 	return result, err
 }
 
-func (t *TraceDB) Exec(query string, args ...interface{}) (stdSql.Result, error) {
-	span := opentracing.StartSpan("Exec")
+func (t *TraceDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if ctx, ok := t.fallback(); ok {
+		return t.ExecContext(ctx, query, args...)
+	}
+	span, _ := t.startSpan(context.Background(), "Exec", query)
 	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", query), log.Object("args", args))
+	span.LogFields(log.Event("debug"), log.Object("args", t.redact(query, args)))
 	result, err := t.DB.Exec(query, args...)
 	if err != nil {
+		ext.Error.Set(span, true)
 		span.LogFields(log.Event("error"), log.Error(err))
 	}
 	return result, err
 }
 
-func (t *TraceDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*stdSql.Rows, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryContext")
-	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", query), log.Object("args", args))
+func (t *TraceDB) QueryContext(ctx context.Context, query string, args ...interface{}) (sql.Rows, error) {
+	span, ctx := t.startSpan(ctx, "QueryContext", query)
+	span.LogFields(log.Event("debug"), log.Object("args", t.redact(query, args)))
 	rows, err := t.DB.QueryContext(ctx, query, args...)
-	if err != nil {
-		span.LogFields(log.Event("error"), log.Error(err))
-	}
-	return rows, err
+	return traceRows(span, rows, err)
 }
 
-func (t *TraceDB) Query(query string, args ...interface{}) (*stdSql.Rows, error) {
-	span := opentracing.StartSpan("Query")
-	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", query), log.Object("args", args))
-	rows, err := t.DB.Query(query, args...)
-	if err != nil {
-		span.LogFields(log.Event("error"), log.Error(err))
+func (t *TraceDB) Query(query string, args ...interface{}) (sql.Rows, error) {
+	if ctx, ok := t.fallback(); ok {
+		return t.QueryContext(ctx, query, args...)
 	}
-	return rows, err
+	span, _ := t.startSpan(context.Background(), "Query", query)
+	span.LogFields(log.Event("debug"), log.Object("args", t.redact(query, args)))
+	rows, err := t.DB.Query(query, args...)
+	return traceRows(span, rows, err)
 }
 
-func (t *TraceDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *stdSql.Row {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRowContext")
-	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", query), log.Object("args", args))
-	return t.DB.QueryRowContext(ctx, query, args...)
+func (t *TraceDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) sql.Row {
+	span, ctx := t.startSpan(ctx, "QueryRowContext", query)
+	span.LogFields(log.Event("debug"), log.Object("args", t.redact(query, args)))
+	return traceRow(span, t.DB.QueryRowContext(ctx, query, args...))
 }
 
-func (t *TraceDB) QueryRow(query string, args ...interface{}) *stdSql.Row {
-	span := opentracing.StartSpan("QueryRow")
-	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", query), log.Object("args", args))
-	return t.DB.QueryRow(query, args...)
+func (t *TraceDB) QueryRow(query string, args ...interface{}) sql.Row {
+	if ctx, ok := t.fallback(); ok {
+		return t.QueryRowContext(ctx, query, args...)
+	}
+	span, _ := t.startSpan(context.Background(), "QueryRow", query)
+	span.LogFields(log.Event("debug"), log.Object("args", t.redact(query, args)))
+	return traceRow(span, t.DB.QueryRow(query, args...))
 }
 
 func (t *TraceDB) BeginTx(ctx context.Context, opts *stdSql.TxOptions) (sql.Tx, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "BeginTx")
-	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.Object("opts", opts))
-	tx, err := t.DB.BeginTx(ctx, opts)
-	if err != nil {
-		span.LogFields(log.Event("error"), log.Error(err))
-	}
-	return &TraceTx{tx}, err
+	return t.beginTx(ctx, "BeginTx", opts, func(ctx context.Context) (sql.Tx, error) {
+		return t.DB.BeginTx(ctx, opts)
+	})
 }
 
 func (t *TraceDB) Begin() (sql.Tx, error) {
-	span := opentracing.StartSpan("Begin")
-	defer span.Finish()
-	tx, err := t.DB.Begin()
-	if err != nil {
-		span.LogFields(log.Event("error"), log.Error(err))
+	if ctx, ok := t.fallback(); ok {
+		return t.BeginTx(ctx, nil)
 	}
-	return &TraceTx{tx}, err
+	return t.beginTx(context.Background(), "Begin", nil, func(context.Context) (sql.Tx, error) {
+		return t.DB.Begin()
+	})
 }
 
 func (t *TraceDB) Driver() driver.Driver {
-	span := opentracing.StartSpan("Driver")
+	if t.Options.SkipConfigSpans {
+		return t.DB.Driver()
+	}
+	span, _ := t.startSpan(context.Background(), "Driver", "")
 	defer span.Finish()
 	return t.DB.Driver()
 }
 
 func (t *TraceDB) Conn(ctx context.Context) (sql.Conn, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "Conn")
+	span, ctx := t.startSpan(ctx, "Conn", "")
 	defer span.Finish()
 	conn, err := t.DB.Conn(ctx)
 	if err != nil {
+		ext.Error.Set(span, true)
 		span.LogFields(log.Event("error"), log.Error(err))
 	}
-	return &TraceConn{conn}, err
+	return &TraceConn{conn, t}, err
 }
 
 type TraceStmt struct {
 	sql.Stmt
 	query string
+	db    *TraceDB
+	// txSpan is the span of the transaction of the statement, if any, which
+	// is the parent of the spans of the statement.
+	txSpan opentracing.Span
+}
+
+// Unwrap returns the wrapped Stmt.
+func (s *TraceStmt) Unwrap() sql.Stmt {
+	return s.Stmt
 }
 
-func (s *TraceStmt) ExecContext(ctx context.Context, args ...interface{}) (stdSql.Result, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "ExecContext")
+// context returns the context with the transaction span, if any.
+func (s *TraceStmt) context(ctx context.Context) context.Context {
+	if s.txSpan == nil {
+		return ctx
+	}
+	return opentracing.ContextWithSpan(ctx, s.txSpan)
+}
+
+func (s *TraceStmt) ExecContext(ctx context.Context, args ...interface{}) (sql.Result, error) {
+	span, ctx := s.db.startSpan(s.context(ctx), "ExecContext", s.query)
 	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", s.query), log.Object("args", args))
+	span.LogFields(log.Event("debug"), log.Object("args", s.db.redact(s.query, args)))
 	result, err := s.Stmt.ExecContext(ctx, args...)
 	if err != nil {
+		ext.Error.Set(span, true)
 		span.LogFields(log.Event("error"), log.Error(err))
 	}
 	return result, err
 }
-func (s *TraceStmt) Exec(args ...interface{}) (stdSql.Result, error) {
-	span := opentracing.StartSpan("Exec")
+func (s *TraceStmt) Exec(args ...interface{}) (sql.Result, error) {
+	if ctx, ok := s.db.fallback(); ok {
+		return s.ExecContext(ctx, args...)
+	}
+	span, _ := s.db.startSpan(s.context(context.Background()), "Exec", s.query)
 	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", s.query), log.Object("args", args))
+	span.LogFields(log.Event("debug"), log.Object("args", s.db.redact(s.query, args)))
 	result, err := s.Stmt.Exec(args...)
 	if err != nil {
+		ext.Error.Set(span, true)
 		span.LogFields(log.Event("error"), log.Error(err))
 	}
 	return result, err
 }
-func (s *TraceStmt) QueryContext(ctx context.Context, args ...interface{}) (*stdSql.Rows, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryContext")
-	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", s.query), log.Object("args", args))
-	result, err := s.Stmt.QueryContext(ctx, args...)
-	if err != nil {
-		span.LogFields(log.Event("error"), log.Error(err))
+func (s *TraceStmt) QueryContext(ctx context.Context, args ...interface{}) (sql.Rows, error) {
+	span, ctx := s.db.startSpan(s.context(ctx), "QueryContext", s.query)
+	span.LogFields(log.Event("debug"), log.Object("args", s.db.redact(s.query, args)))
+	rows, err := s.Stmt.QueryContext(ctx, args...)
+	return traceRows(span, rows, err)
+}
+func (s *TraceStmt) Query(args ...interface{}) (sql.Rows, error) {
+	if ctx, ok := s.db.fallback(); ok {
+		return s.QueryContext(ctx, args...)
 	}
-	return result, err
+	span, _ := s.db.startSpan(s.context(context.Background()), "Query", s.query)
+	span.LogFields(log.Event("debug"), log.Object("args", s.db.redact(s.query, args)))
+	rows, err := s.Stmt.Query(args...)
+	return traceRows(span, rows, err)
+}
+func (s *TraceStmt) QueryRowContext(ctx context.Context, args ...interface{}) sql.Row {
+	span, ctx := s.db.startSpan(s.context(ctx), "QueryRowContext", s.query)
+	span.LogFields(log.Event("debug"), log.Object("args", s.db.redact(s.query, args)))
+	return traceRow(span, s.Stmt.QueryRowContext(ctx, args...))
+}
+func (s *TraceStmt) QueryRow(args ...interface{}) sql.Row {
+	if ctx, ok := s.db.fallback(); ok {
+		return s.QueryRowContext(ctx, args...)
+	}
+	span, _ := s.db.startSpan(s.context(context.Background()), "QueryRow", s.query)
+	span.LogFields(log.Event("debug"), log.Object("args", s.db.redact(s.query, args)))
+	return traceRow(span, s.Stmt.QueryRow(args...))
 }
-func (s *TraceStmt) Query(args ...interface{}) (*stdSql.Rows, error) {
-	span := opentracing.StartSpan("Query")
-	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", s.query), log.Object("args", args))
-	result, err := s.Stmt.Query(args...)
-	if err != nil {
-		span.LogFields(log.Event("error"), log.Error(err))
+
+// TraceTx traces the calls to the transaction. The spans of the statements and
+// Commit or Rollback are the children of the transaction span, which is
+// started by BeginTx and finished by Commit or Rollback.
+type TraceTx struct {
+	sql.Tx
+	db   *TraceDB
+	span opentracing.Span
+	done int32
+}
+
+// Unwrap returns the wrapped Tx.
+func (t *TraceTx) Unwrap() sql.Tx {
+	return t.Tx
+}
+
+// context returns the context with the transaction span, if any.
+func (t *TraceTx) context(ctx context.Context) context.Context {
+	if t.span == nil {
+		return ctx
 	}
-	return result, err
+	return opentracing.ContextWithSpan(ctx, t.span)
 }
-func (s *TraceStmt) QueryRowContext(ctx context.Context, args ...interface{}) *stdSql.Row {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRowContext")
-	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", s.query), log.Object("args", args))
-	return s.Stmt.QueryRowContext(ctx, args...)
+
+// end traces the end of the transaction by Commit or Rollback, and finishes
+// the transaction span. The calls after the end are not traced, such as the
+// deferred Rollback after Commit.
+func (t *TraceTx) end(operation string, f func() error) error {
+	if atomic.LoadInt32(&t.done) != 0 {
+		return f()
+	}
+	span, _ := t.db.startSpan(t.context(context.Background()), operation, "")
+	err := f()
+	if err != nil {
+		failSpan(span, err)
+	}
+	span.Finish()
+	if t.span != nil && atomic.CompareAndSwapInt32(&t.done, 0, 1) {
+		if err != nil && err != stdSql.ErrTxDone {
+			failSpan(t.span, err)
+		}
+		t.span.Finish()
+	}
+	return err
 }
-func (s *TraceStmt) QueryRow(args ...interface{}) *stdSql.Row {
-	span := opentracing.StartSpan("QueryRow")
-	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", s.query), log.Object("args", args))
-	return s.Stmt.QueryRow(args...)
+
+func (t *TraceTx) Commit() error {
+	return t.end("Commit", t.Tx.Commit)
 }
 
-type TraceTx struct {
-	sql.Tx
+func (t *TraceTx) Rollback() error {
+	return t.end("Rollback", t.Tx.Rollback)
 }
 
 func (t *TraceTx) PrepareContext(ctx context.Context, query string) (sql.Stmt, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "PrepareContext")
+	span, ctx := t.db.startSpan(t.context(ctx), "PrepareContext", query)
 	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", query))
 	stmt, err := t.Tx.PrepareContext(ctx, query)
 	if err != nil {
+		ext.Error.Set(span, true)
 		span.LogFields(log.Event("error"), log.Error(err))
 	}
-	return &TraceStmt{stmt, query}, err
+	return &TraceStmt{stmt, query, t.db, t.span}, err
 }
 
 func (t *TraceTx) Prepare(query string) (sql.Stmt, error) {
-	span := opentracing.StartSpan("Prepare")
+	if ctx, ok := t.db.fallback(); ok {
+		return t.PrepareContext(ctx, query)
+	}
+	span, _ := t.db.startSpan(t.context(context.Background()), "Prepare", query)
 	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", query))
 	stmt, err := t.Tx.Prepare(query)
 	if err != nil {
+		ext.Error.Set(span, true)
 		span.LogFields(log.Event("error"), log.Error(err))
 	}
-	return &TraceStmt{stmt, query}, err
+	return &TraceStmt{stmt, query, t.db, t.span}, err
 }
 
 func (t *TraceTx) StmtContext(ctx context.Context, stmt sql.Stmt) sql.Stmt {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "StmtContext")
+	span, ctx := t.db.startSpan(t.context(ctx), "StmtContext", sql.QueryString(stmt))
 	defer span.Finish()
-	return &TraceStmt{t.Tx.StmtContext(ctx, stmt), ""}
+	return &TraceStmt{t.Tx.StmtContext(ctx, stmt), sql.QueryString(stmt), t.db, t.span}
 }
 
 func (t *TraceTx) Stmt(stmt sql.Stmt) sql.Stmt {
-	span := opentracing.StartSpan("Stmt")
+	if ctx, ok := t.db.fallback(); ok {
+		return t.StmtContext(ctx, stmt)
+	}
+	span, _ := t.db.startSpan(t.context(context.Background()), "Stmt", sql.QueryString(stmt))
 	defer span.Finish()
-	return &TraceStmt{t.Tx.Stmt(stmt), ""}
+	return &TraceStmt{t.Tx.Stmt(stmt), sql.QueryString(stmt), t.db, t.span}
 }
 
-func (t *TraceTx) ExecContext(ctx context.Context, query string, args ...interface{}) (stdSql.Result, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "ExecContext")
+func (t *TraceTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	span, ctx := t.db.startSpan(t.context(ctx), "ExecContext", query)
 	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", query), log.Object("args", args))
+	span.LogFields(log.Event("debug"), log.Object("args", t.db.redact(query, args)))
 	result, err := t.Tx.ExecContext(ctx, query, args...)
 	if err != nil {
+		ext.Error.Set(span, true)
 		span.LogFields(log.Event("error"), log.Error(err))
 	}
 	return result, err
 }
 
-func (t *TraceTx) Exec(query string, args ...interface{}) (stdSql.Result, error) {
-	span := opentracing.StartSpan("Exec")
+func (t *TraceTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if ctx, ok := t.db.fallback(); ok {
+		return t.ExecContext(ctx, query, args...)
+	}
+	span, _ := t.db.startSpan(t.context(context.Background()), "Exec", query)
 	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", query), log.Object("args", args))
+	span.LogFields(log.Event("debug"), log.Object("args", t.db.redact(query, args)))
 	result, err := t.Tx.Exec(query, args...)
 	if err != nil {
+		ext.Error.Set(span, true)
 		span.LogFields(log.Event("error"), log.Error(err))
 	}
 	return result, err
 }
 
-func (t *TraceTx) QueryContext(ctx context.Context, query string, args ...interface{}) (*stdSql.Rows, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryContext")
-	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", query), log.Object("args", args))
+func (t *TraceTx) QueryContext(ctx context.Context, query string, args ...interface{}) (sql.Rows, error) {
+	span, ctx := t.db.startSpan(t.context(ctx), "QueryContext", query)
+	span.LogFields(log.Event("debug"), log.Object("args", t.db.redact(query, args)))
 	rows, err := t.Tx.QueryContext(ctx, query, args...)
-	if err != nil {
-		span.LogFields(log.Event("error"), log.Error(err))
-	}
-	return rows, err
+	return traceRows(span, rows, err)
 }
 
-func (t *TraceTx) Query(query string, args ...interface{}) (*stdSql.Rows, error) {
-	span := opentracing.StartSpan("Query")
-	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", query), log.Object("args", args))
-	rows, err := t.Tx.Query(query, args...)
-	if err != nil {
-		span.LogFields(log.Event("error"), log.Error(err))
+func (t *TraceTx) Query(query string, args ...interface{}) (sql.Rows, error) {
+	if ctx, ok := t.db.fallback(); ok {
+		return t.QueryContext(ctx, query, args...)
 	}
-	return rows, err
+	span, _ := t.db.startSpan(t.context(context.Background()), "Query", query)
+	span.LogFields(log.Event("debug"), log.Object("args", t.db.redact(query, args)))
+	rows, err := t.Tx.Query(query, args...)
+	return traceRows(span, rows, err)
 }
 
-func (t *TraceTx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *stdSql.Row {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRowContext")
-	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", query), log.Object("args", args))
-	return t.Tx.QueryRowContext(ctx, query, args...)
+func (t *TraceTx) QueryRowContext(ctx context.Context, query string, args ...interface{}) sql.Row {
+	span, ctx := t.db.startSpan(t.context(ctx), "QueryRowContext", query)
+	span.LogFields(log.Event("debug"), log.Object("args", t.db.redact(query, args)))
+	return traceRow(span, t.Tx.QueryRowContext(ctx, query, args...))
 }
 
-func (t *TraceTx) QueryRow(query string, args ...interface{}) *stdSql.Row {
-	span := opentracing.StartSpan("QueryRow")
-	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", query), log.Object("args", args))
-	return t.Tx.QueryRow(query, args...)
+func (t *TraceTx) QueryRow(query string, args ...interface{}) sql.Row {
+	if ctx, ok := t.db.fallback(); ok {
+		return t.QueryRowContext(ctx, query, args...)
+	}
+	span, _ := t.db.startSpan(t.context(context.Background()), "QueryRow", query)
+	span.LogFields(log.Event("debug"), log.Object("args", t.db.redact(query, args)))
+	return traceRow(span, t.Tx.QueryRow(query, args...))
 }
 
 type TraceConn struct {
 	sql.Conn
+	db *TraceDB
+}
+
+// Unwrap returns the wrapped Conn.
+func (t *TraceConn) Unwrap() sql.Conn {
+	return t.Conn
 }
 
 func (t *TraceConn) PingContext(ctx context.Context) error {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "PingContext")
+	span, ctx := t.db.startSpan(ctx, "PingContext", "")
 	defer span.Finish()
 	err := t.Conn.PingContext(ctx)
 	if err != nil {
+		ext.Error.Set(span, true)
 		span.LogFields(log.Event("error"), log.Error(err))
 	}
 	return err
 }
-func (t *TraceConn) ExecContext(ctx context.Context, query string, args ...interface{}) (stdSql.Result, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "ExecContext")
+func (t *TraceConn) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	span, ctx := t.db.startSpan(ctx, "ExecContext", query)
 	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", query), log.Object("args", args))
+	span.LogFields(log.Event("debug"), log.Object("args", t.db.redact(query, args)))
 	result, err := t.Conn.ExecContext(ctx, query, args...)
 	if err != nil {
+		ext.Error.Set(span, true)
 		span.LogFields(log.Event("error"), log.Error(err))
 	}
 	return result, err
 }
-func (t *TraceConn) QueryContext(ctx context.Context, query string, args ...interface{}) (*stdSql.Rows, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryContext")
-	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", query), log.Object("args", args))
+func (t *TraceConn) QueryContext(ctx context.Context, query string, args ...interface{}) (sql.Rows, error) {
+	span, ctx := t.db.startSpan(ctx, "QueryContext", query)
+	span.LogFields(log.Event("debug"), log.Object("args", t.db.redact(query, args)))
 	rows, err := t.Conn.QueryContext(ctx, query, args...)
-	if err != nil {
-		span.LogFields(log.Event("error"), log.Error(err))
-	}
-	return rows, err
+	return traceRows(span, rows, err)
 }
-func (t *TraceConn) QueryRowContext(ctx context.Context, query string, args ...interface{}) *stdSql.Row {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRowContext")
-	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", query), log.Object("args", args))
-	return t.Conn.QueryRowContext(ctx, query, args...)
+func (t *TraceConn) QueryRowContext(ctx context.Context, query string, args ...interface{}) sql.Row {
+	span, ctx := t.db.startSpan(ctx, "QueryRowContext", query)
+	span.LogFields(log.Event("debug"), log.Object("args", t.db.redact(query, args)))
+	return traceRow(span, t.Conn.QueryRowContext(ctx, query, args...))
 }
 func (t *TraceConn) PrepareContext(ctx context.Context, query string) (sql.Stmt, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "PrepareContext")
+	span, ctx := t.db.startSpan(ctx, "PrepareContext", query)
 	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.String("query", query))
 	stmt, err := t.Conn.PrepareContext(ctx, query)
 	if err != nil {
+		ext.Error.Set(span, true)
 		span.LogFields(log.Event("error"), log.Error(err))
 	}
-	return &TraceStmt{stmt, query}, err
+	return &TraceStmt{stmt, query, t.db, nil}, err
 }
 func (t *TraceConn) BeginTx(ctx context.Context, opts *stdSql.TxOptions) (sql.Tx, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "BeginTx")
-	defer span.Finish()
-	span.LogFields(log.Event("debug"), log.Object("opts", opts))
-	tx, err := t.Conn.BeginTx(ctx, opts)
+	return t.db.beginTx(ctx, "BeginTx", opts, func(ctx context.Context) (sql.Tx, error) {
+		return t.Conn.BeginTx(ctx, opts)
+	})
+}
+
+// beginTx begins a transaction with begin. The transaction span is started
+// before it, and the span of the operation is its child.
+func (t *TraceDB) beginTx(ctx context.Context, operation string, opts *stdSql.TxOptions, begin func(ctx context.Context) (sql.Tx, error)) (sql.Tx, error) {
+	txSpan, ctx := t.startSpan(ctx, "Transaction", "")
+	isolation, readOnly := stdSql.LevelDefault, false
+	if opts != nil {
+		isolation, readOnly = opts.Isolation, opts.ReadOnly
+	}
+	txSpan.SetTag(TagIsolationLevel, isolation.String())
+	txSpan.SetTag(TagReadOnly, readOnly)
+	span, ctx := t.startSpan(ctx, operation, "")
+	tx, err := begin(ctx)
 	if err != nil {
-		span.LogFields(log.Event("error"), log.Error(err))
+		failSpan(span, err)
+		failSpan(txSpan, err)
+		span.Finish()
+		txSpan.Finish()
+		return &TraceTx{Tx: tx, db: t, done: 1}, err
+	}
+	span.Finish()
+	return &TraceTx{Tx: tx, db: t, span: txSpan}, nil
+}
+
+// failSpan marks the span with the error.
+func failSpan(span opentracing.Span, err error) {
+	ext.Error.Set(span, true)
+	span.LogFields(log.Event("error"), log.Error(err))
+}
+
+// traceRows returns the rows which finish the span at Close, or finishes the
+// span now if the query fails.
+func traceRows(span opentracing.Span, rows sql.Rows, err error) (sql.Rows, error) {
+	if err != nil {
+		failSpan(span, err)
+		span.Finish()
+		return rows, err
+	}
+	return &TraceRows{Rows: rows, span: span}, nil
+}
+
+// TraceRows keeps the span of the query open until the rows are closed, so the
+// span covers the iteration of the rows. The rows are closed by Close, or by
+// the Next returning false at the end of the last result set, which closes
+// the rows in the database/sql package. The number of the fetched rows and the
+// error of the iteration are recorded in the span.
+type TraceRows struct {
+	sql.Rows
+	span    opentracing.Span
+	fetched int64
+	done    int32
+}
+
+// Unwrap returns the wrapped Rows.
+func (r *TraceRows) Unwrap() sql.Rows {
+	return r.Rows
+}
+
+func (r *TraceRows) Next() bool {
+	if r.Rows.Next() {
+		r.fetched++
+		return true
+	}
+	// The rows are still open if there is another result set, then Columns
+	// doesn't fail.
+	if _, err := r.Rows.Columns(); err != nil {
+		r.finish(nil)
+	}
+	return false
+}
+
+func (r *TraceRows) Close() error {
+	err := r.Rows.Close()
+	r.finish(err)
+	return err
+}
+
+// finish records the number of the fetched rows and the error of the
+// iteration or the close, and finishes the span once.
+func (r *TraceRows) finish(err error) {
+	if !atomic.CompareAndSwapInt32(&r.done, 0, 1) {
+		return
+	}
+	r.span.SetTag(TagRowsFetched, r.fetched)
+	if rowsErr := r.Rows.Err(); rowsErr != nil {
+		failSpan(r.span, rowsErr)
+	} else if err != nil {
+		failSpan(r.span, err)
+	}
+	r.span.Finish()
+}
+
+// traceRow returns the row which finishes the span at Scan, or finishes the
+// span now if the query fails.
+func traceRow(span opentracing.Span, row sql.Row) sql.Row {
+	r := &TraceRow{Row: row, span: span}
+	if err := row.Err(); err != nil {
+		r.finish(err)
+	}
+	return r
+}
+
+// TraceRow keeps the span of the query open until Scan, or Err returning an
+// error. Err returning nil leaves the span open, since the middlewares such as
+// CacheDB and RetryDB call it before the Scan of the caller. The span is
+// tagged with TagNoRows instead of the error tag if Scan finds no rows.
+type TraceRow struct {
+	sql.Row
+	span opentracing.Span
+	done int32
+}
+
+// Unwrap returns the wrapped Row.
+func (r *TraceRow) Unwrap() sql.Row {
+	return r.Row
+}
+
+func (r *TraceRow) Scan(dest ...interface{}) error {
+	err := r.Row.Scan(dest...)
+	r.finish(err)
+	return err
+}
+
+func (r *TraceRow) Err() error {
+	err := r.Row.Err()
+	if err != nil {
+		r.finish(err)
+	}
+	return err
+}
+
+func (r *TraceRow) finish(err error) {
+	if !atomic.CompareAndSwapInt32(&r.done, 0, 1) {
+		return
+	}
+	switch {
+	case errors.Is(err, stdSql.ErrNoRows):
+		r.span.SetTag(TagNoRows, true)
+		r.span.SetTag(TagRowsFetched, int64(0))
+	case err != nil:
+		failSpan(r.span, err)
+	default:
+		r.span.SetTag(TagRowsFetched, int64(1))
 	}
-	return &TraceTx{tx}, err
+	r.span.Finish()
 }
@@ -0,0 +1,158 @@
+package middleware
+
+import (
+	"context"
+	stdSql "database/sql"
+	"database/sql/driver"
+	"github.com/developerdong/sql"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+var (
+	_ sql.DriverConn = (*TraceDriverConn)(nil)
+	_ sql.DriverStmt = (*TraceDriverStmt)(nil)
+	_ sql.DriverTx   = (*TraceDriverTx)(nil)
+)
+
+// TraceDriverConn is the driver-level counterpart of TraceDB, which traces the
+// calls to the driver connection with opentracing. The spans are started in the
+// same way as TraceDB, with the same names and tags.
+type TraceDriverConn struct {
+	sql.DriverConn
+	// db holds the options of the spans, which is shared by the connections.
+	// The default options are used if it is nil.
+	db *TraceDB
+}
+
+// NewTraceDriverConn wraps the DriverConn with a TraceDriverConn with the
+// default options. It fits the sql.DriverMiddleware type.
+func NewTraceDriverConn(conn sql.DriverConn) sql.DriverConn {
+	return &TraceDriverConn{DriverConn: conn}
+}
+
+// TraceDriver returns a driver middleware which wraps the connections with a
+// TraceDriverConn with the options. The options of the context-less and the
+// configuration methods don't apply to the driver level.
+func TraceDriver(opts TraceOptions) sql.DriverMiddleware {
+	db := &TraceDB{Options: opts}
+	return func(conn sql.DriverConn) sql.DriverConn {
+		return &TraceDriverConn{conn, db}
+	}
+}
+
+// finishDriverSpan marks the span with the error, except driver.ErrSkip which
+// only asks the database/sql package to take another way, and finishes the
+// span.
+func finishDriverSpan(span opentracing.Span, err error) {
+	if err != nil && err != driver.ErrSkip {
+		ext.Error.Set(span, true)
+		span.LogFields(log.Event("error"), log.Error(err))
+	}
+	span.Finish()
+}
+
+// redactDriver returns the driver arguments of the query to be logged. The
+// named arguments are redacted as sql.NamedArg, so their names are honored.
+func (t *TraceDB) redactDriver(query string, args []driver.NamedValue) []interface{} {
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			values[i] = stdSql.NamedArg{Name: arg.Name, Value: arg.Value}
+		} else {
+			values[i] = arg.Value
+		}
+	}
+	return t.redact(query, values)
+}
+
+func (t *TraceDriverConn) PrepareContext(ctx context.Context, query string) (sql.DriverStmt, error) {
+	span, ctx := t.db.startSpan(ctx, "PrepareContext", query)
+	stmt, err := t.DriverConn.PrepareContext(ctx, query)
+	finishDriverSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return &TraceDriverStmt{stmt, query, t.db}, nil
+}
+
+func (t *TraceDriverConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	span, ctx := t.db.startSpan(ctx, "ExecContext", query)
+	span.LogFields(log.Event("debug"), log.Object("args", t.db.redactDriver(query, args)))
+	result, err := t.DriverConn.ExecContext(ctx, query, args)
+	finishDriverSpan(span, err)
+	return result, err
+}
+
+func (t *TraceDriverConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (sql.DriverRows, error) {
+	span, ctx := t.db.startSpan(ctx, "QueryContext", query)
+	span.LogFields(log.Event("debug"), log.Object("args", t.db.redactDriver(query, args)))
+	rows, err := t.DriverConn.QueryContext(ctx, query, args)
+	finishDriverSpan(span, err)
+	return rows, err
+}
+
+func (t *TraceDriverConn) BeginTx(ctx context.Context, opts driver.TxOptions) (sql.DriverTx, error) {
+	span, spanCtx := t.db.startSpan(ctx, "BeginTx", "")
+	span.SetTag(TagIsolationLevel, stdSql.IsolationLevel(opts.Isolation).String())
+	span.SetTag(TagReadOnly, opts.ReadOnly)
+	tx, err := t.DriverConn.BeginTx(spanCtx, opts)
+	finishDriverSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return &TraceDriverTx{tx, ctx, t.db}, nil
+}
+
+func (t *TraceDriverConn) Ping(ctx context.Context) error {
+	span, ctx := t.db.startSpan(ctx, "Ping", "")
+	err := t.DriverConn.Ping(ctx)
+	finishDriverSpan(span, err)
+	return err
+}
+
+// TraceDriverStmt traces the calls to the driver statement.
+type TraceDriverStmt struct {
+	sql.DriverStmt
+	query string
+	db    *TraceDB
+}
+
+func (s *TraceDriverStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	span, ctx := s.db.startSpan(ctx, "ExecContext", s.query)
+	span.LogFields(log.Event("debug"), log.Object("args", s.db.redactDriver(s.query, args)))
+	result, err := s.DriverStmt.ExecContext(ctx, args)
+	finishDriverSpan(span, err)
+	return result, err
+}
+
+func (s *TraceDriverStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (sql.DriverRows, error) {
+	span, ctx := s.db.startSpan(ctx, "QueryContext", s.query)
+	span.LogFields(log.Event("debug"), log.Object("args", s.db.redactDriver(s.query, args)))
+	rows, err := s.DriverStmt.QueryContext(ctx, args)
+	finishDriverSpan(span, err)
+	return rows, err
+}
+
+// TraceDriverTx traces the commit and the rollback of the driver transaction,
+// as the children of the span in the context passed to BeginTx.
+type TraceDriverTx struct {
+	sql.DriverTx
+	ctx context.Context
+	db  *TraceDB
+}
+
+func (t *TraceDriverTx) Commit() error {
+	span, _ := t.db.startSpan(t.ctx, "Commit", "")
+	err := t.DriverTx.Commit()
+	finishDriverSpan(span, err)
+	return err
+}
+
+func (t *TraceDriverTx) Rollback() error {
+	span, _ := t.db.startSpan(t.ctx, "Rollback", "")
+	err := t.DriverTx.Rollback()
+	finishDriverSpan(span, err)
+	return err
+}
@@ -0,0 +1,397 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	s "github.com/developerdong/sql"
+	"github.com/developerdong/sql/redact"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTraceDB_SpanName(t *testing.T) {
+	db, _ := openFake()
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	tracer := mocktracer.New()
+	traceDb := &TraceDB{DB: &s.BaseDB{DB: db}, Options: TraceOptions{Tracer: tracer, SpanName: FingerprintSpanName}}
+	ctx := context.Background()
+	if _, err := traceDb.ExecContext(ctx, "UPDATE t SET a = 1 WHERE id IN (1, 2)"); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := traceDb.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM t WHERE id = 3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, span := range tracer.FinishedSpans() {
+		names = append(names, span.OperationName)
+	}
+	expected := []string{
+		"ExecContext update t set a = ? where id in(?+)",
+		"BeginTx",
+		"ExecContext delete from t where id = ?",
+		"Commit",
+		"Transaction",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %q, got %q", expected, names)
+	}
+}
+
+func TestTraceDB_Tags(t *testing.T) {
+	db, d := openFake()
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	tracer := mocktracer.New()
+	traceDb := s.Chain(&s.BaseDB{DB: db}, Trace(TraceOptions{
+		Tracer: tracer,
+		DSN:    "user:password@tcp(db.example.com:3306)/app",
+	}))
+	parent := tracer.StartSpan("parent")
+	ctx := opentracing.ContextWithSpan(context.Background(), parent)
+	d.setFail(func(query string) error {
+		if query == "FAIL" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	if _, err := traceDb.ExecContext(ctx, "UPDATE t SET a = ?", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := traceDb.ExecContext(ctx, "FAIL"); err == nil {
+		t.Fatal("expected an error")
+	}
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	expected := map[string]interface{}{
+		"db.type":      "sql",
+		"db.instance":  "app",
+		"db.user":      "user",
+		"peer.address": "db.example.com:3306",
+		"span.kind":    ext.SpanKindRPCClientEnum,
+		"db.statement": "UPDATE t SET a = ?",
+	}
+	if tags := spans[0].Tags(); !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("expected %v, got %v", expected, tags)
+	}
+	if parentID := spans[0].ParentID; parentID != parent.(*mocktracer.MockSpan).SpanContext.SpanID {
+		t.Fatalf("expected the parent %d, got %d", parent.(*mocktracer.MockSpan).SpanContext.SpanID, parentID)
+	}
+	if failed := spans[1].Tag(string(ext.Error)); failed != true {
+		t.Fatalf("expected the error tag, got %v", failed)
+	}
+}
+
+func TestTraceDB_Rows(t *testing.T) {
+	db, d := openFake()
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	errFake := errors.New("fake")
+	d.setFail(func(query string) error {
+		if query == "FAIL" {
+			return errFake
+		}
+		return nil
+	})
+	tracer := mocktracer.New()
+	traceDb := &TraceDB{DB: &s.BaseDB{DB: db}, Options: TraceOptions{Tracer: tracer}}
+	ctx := context.Background()
+	rows, err := traceDb.QueryContext(ctx, "SELECT a FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rows.Next() {
+		t.Fatal("expected a row")
+	}
+	if spans := len(tracer.FinishedSpans()); spans != 0 {
+		t.Fatalf("expected the span to be open during the iteration, got %d finished", spans)
+	}
+	// The span is finished once the rows are drained, even without Close.
+	if rows.Next() {
+		t.Fatal("expected no more rows")
+	}
+	if spans := len(tracer.FinishedSpans()); spans != 1 {
+		t.Fatalf("expected the span to be finished after the rows are drained, got %d finished", spans)
+	}
+	if err := rows.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var value string
+	if err := traceDb.QueryRowContext(ctx, "SELECT b FROM t").Scan(&value); err != nil {
+		t.Fatal(err)
+	}
+	if err := traceDb.QueryRowContext(ctx, "EMPTY").Scan(&value); err != sql.ErrNoRows {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+	// Err returning nil leaves the span open until Scan.
+	row := traceDb.QueryRowContext(ctx, "SELECT c FROM t")
+	if err := row.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if spans := len(tracer.FinishedSpans()); spans != 3 {
+		t.Fatalf("expected the span to be open after Err, got %d finished", spans)
+	}
+	if err := traceDb.QueryRowContext(ctx, "FAIL").Err(); err != errFake {
+		t.Fatalf("expected %v, got %v", errFake, err)
+	}
+	if err := row.Scan(&value); err != nil {
+		t.Fatal(err)
+	}
+	spans := tracer.FinishedSpans()
+	if len(spans) != 5 {
+		t.Fatalf("expected 5 spans, got %d", len(spans))
+	}
+	for i, expected := range []map[string]interface{}{
+		{TagRowsFetched: int64(1), string(ext.Error): nil, TagNoRows: nil},
+		{TagRowsFetched: int64(1), string(ext.Error): nil, TagNoRows: nil},
+		{TagRowsFetched: int64(0), string(ext.Error): nil, TagNoRows: true},
+		{TagRowsFetched: nil, string(ext.Error): true, TagNoRows: nil},
+		{TagRowsFetched: int64(1), string(ext.Error): nil, TagNoRows: nil},
+	} {
+		for tag, value := range expected {
+			if actual := spans[i].Tag(tag); actual != value {
+				t.Errorf("span %d: expected %s to be %v, got %v", i, tag, value, actual)
+			}
+		}
+	}
+}
+
+func TestTraceDB_RowUnderCacheDB(t *testing.T) {
+	db, _ := openFake()
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	tracer := mocktracer.New()
+	cacheDb := &CacheDB{DB: &TraceDB{DB: &s.BaseDB{DB: db}, Options: TraceOptions{Tracer: tracer}}}
+	ctx := context.Background()
+	// CacheDB calls Err before the Scan below.
+	row := cacheDb.QueryRowContext(ctx, "EMPTY")
+	for _, span := range tracer.FinishedSpans() {
+		if span.OperationName != "PrepareContext" {
+			t.Fatalf("expected the %s span to be open before Scan", span.OperationName)
+		}
+	}
+	var value string
+	if err := row.Scan(&value); err != sql.ErrNoRows {
+		t.Fatalf("expected sql.ErrNoRows, got %v", err)
+	}
+	spans := tracer.FinishedSpans()
+	span := spans[len(spans)-1]
+	if span.Tag(TagNoRows) != true || span.Tag(TagRowsFetched) != int64(0) {
+		t.Fatalf("expected the %s span to be tagged with no rows, got %v", span.OperationName, span.Tags())
+	}
+}
+
+func TestTraceTx(t *testing.T) {
+	db, _ := openFake()
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	tracer := mocktracer.New()
+	traceDb := &TraceDB{DB: &s.BaseDB{DB: db}, Options: TraceOptions{Tracer: tracer}}
+	ctx := context.Background()
+	tx, err := traceDb.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := tx.PrepareContext(ctx, "SELECT a FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value string
+	if err := stmt.QueryRowContext(ctx).Scan(&value); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	// The deferred Rollback after the end is not traced.
+	if err := tx.Rollback(); err != sql.ErrTxDone {
+		t.Fatalf("expected sql.ErrTxDone, got %v", err)
+	}
+	spans := tracer.FinishedSpans()
+	if len(spans) != 5 {
+		t.Fatalf("expected 5 spans, got %d", len(spans))
+	}
+	txSpan := spans[len(spans)-1]
+	if txSpan.OperationName != "Transaction" {
+		t.Fatalf("expected the transaction span, got %s", txSpan.OperationName)
+	}
+	if level, readOnly := txSpan.Tag(TagIsolationLevel), txSpan.Tag(TagReadOnly); level != "Serializable" || readOnly != true {
+		t.Fatalf("expected a serializable read-only transaction, got %v and %v", level, readOnly)
+	}
+	for _, span := range spans[:len(spans)-1] {
+		if span.ParentID != txSpan.SpanContext.SpanID {
+			t.Errorf("expected %s to be a child of the transaction", span.OperationName)
+		}
+	}
+}
+
+func TestTraceDB_Redact(t *testing.T) {
+	db, _ := openFake()
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	tracer := mocktracer.New()
+	traceDb := &TraceDB{DB: &s.BaseDB{DB: db}, Options: TraceOptions{
+		Tracer: tracer,
+		Redact: &redact.Policy{MaskColumns: []string{"password"}},
+	}}
+	if _, err := traceDb.ExecContext(context.Background(), "UPDATE users SET password = ? WHERE id = ?", "secret", 1); err != nil {
+		t.Fatal(err)
+	}
+	var logged string
+	for _, record := range tracer.FinishedSpans()[0].Logs() {
+		for _, field := range record.Fields {
+			if field.Key == "args" {
+				logged = field.ValueString
+			}
+		}
+	}
+	if expected := fmt.Sprint([]interface{}{redact.DefaultMask, 1}); logged != expected {
+		t.Fatalf("expected %q, got %q", expected, logged)
+	}
+}
+
+func TestTraceTx_Savepoint(t *testing.T) {
+	db, _ := openFake()
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	tracer := mocktracer.New()
+	traceDb := &TraceDB{DB: &s.BaseDB{DB: db}, Options: TraceOptions{Tracer: tracer}}
+	ctx := context.Background()
+	tx, err := traceDb.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Savepoint(ctx, tx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, span := range tracer.FinishedSpans() {
+		found = found || span.Tag(string(ext.DBStatement)) == "SAVEPOINT `a`"
+	}
+	if !found {
+		t.Fatal("expected a span of the savepoint")
+	}
+}
+
+func TestTraceTx_Stmt(t *testing.T) {
+	db, _ := openFake()
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	tracer := mocktracer.New()
+	traceDb := &TraceDB{DB: &s.BaseDB{DB: db}, Options: TraceOptions{Tracer: tracer}}
+	ctx := context.Background()
+	stmt, err := traceDb.PrepareContext(ctx, "UPDATE t SET a = ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := traceDb.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txStmt := tx.StmtContext(ctx, stmt)
+	if query := s.QueryString(txStmt); query != "UPDATE t SET a = ?" {
+		t.Fatalf("expected the query of the statement, got %q", query)
+	}
+	if _, err := txStmt.ExecContext(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for _, span := range tracer.FinishedSpans() {
+		if span.OperationName == "ExecContext" && span.Tag("db.statement") != "UPDATE t SET a = ?" {
+			t.Fatalf("expected the statement to be tagged, got %v", span.Tag("db.statement"))
+		}
+	}
+}
+
+func TestTraceDB_SkipConfigSpans(t *testing.T) {
+	db, _ := openFake()
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	tracer := mocktracer.New()
+	traceDb := &TraceDB{DB: &s.BaseDB{DB: db}, Options: TraceOptions{Tracer: tracer, SkipConfigSpans: true}}
+	traceDb.SetMaxIdleConns(1)
+	traceDb.SetMaxOpenConns(2)
+	traceDb.SetConnMaxLifetime(time.Minute)
+	traceDb.SetConnMaxIdleTime(time.Minute)
+	_ = traceDb.Stats()
+	_ = traceDb.Driver()
+	if spans := tracer.FinishedSpans(); len(spans) != 0 {
+		t.Fatalf("expected no spans, got %d", len(spans))
+	}
+	if maxOpen := db.Stats().MaxOpenConnections; maxOpen != 2 {
+		t.Fatalf("expected the config to be set, got %d max open conns", maxOpen)
+	}
+}
+
+func TestTraceDB_RouteContextless(t *testing.T) {
+	db, _ := openFake()
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+	tracer := mocktracer.New()
+	parent := tracer.StartSpan("request")
+	traceDb := &TraceDB{DB: &s.BaseDB{DB: db}, Options: TraceOptions{
+		Tracer:           tracer,
+		RouteContextless: true,
+		FallbackContext: func() context.Context {
+			return opentracing.ContextWithSpan(context.Background(), parent)
+		},
+	}}
+	if _, err := traceDb.Exec("UPDATE t SET a = 1"); err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := traceDb.Prepare("SELECT a FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value string
+	if err := stmt.QueryRow().Scan(&value); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := traceDb.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	parent.Finish()
+	traceID := parent.Context().(mocktracer.MockSpanContext).TraceID
+	for _, span := range tracer.FinishedSpans() {
+		if span.SpanContext.TraceID != traceID {
+			t.Errorf("expected %s to join the trace of the fallback context", span.OperationName)
+		}
+		if span.OperationName == "Exec" || span.OperationName == "QueryRow" {
+			t.Errorf("expected %s to be routed to the context variant", span.OperationName)
+		}
+	}
+}
@@ -0,0 +1,634 @@
+package middleware
+
+import (
+	"context"
+	stdSql "database/sql"
+	"errors"
+	"github.com/developerdong/sql"
+	"github.com/developerdong/sql/sqlparse"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	_ sql.DB            = (*ReplicaDB)(nil)
+	_ sql.Stmt          = (*replicaStmt)(nil)
+	_ sql.Stmt          = (*replicaReadStmt)(nil)
+	_ sql.QueryStringer = (*replicaReadStmt)(nil)
+	_ sql.Tx            = (*replicaTx)(nil)
+	_ sql.Row           = errRow{}
+)
+
+// DefaultGTIDWaitTimeout is the GTID wait timeout of ReplicaDB if
+// GTIDWaitTimeout is 0.
+const DefaultGTIDWaitTimeout = time.Second
+
+// ReplicaSelector selects a replica from the healthy ones, which are never
+// empty.
+type ReplicaSelector func(replicas []sql.DB) sql.DB
+
+// RoundRobin returns a selector which selects the replicas in turn.
+func RoundRobin() ReplicaSelector {
+	var next uint64
+	return func(replicas []sql.DB) sql.DB {
+		return replicas[(atomic.AddUint64(&next, 1)-1)%uint64(len(replicas))]
+	}
+}
+
+// Random returns a selector which selects the replicas randomly.
+func Random() ReplicaSelector {
+	return func(replicas []sql.DB) sql.DB {
+		return replicas[rand.Intn(len(replicas))]
+	}
+}
+
+// LeastInUse returns a selector which selects the replica with the least
+// connections in use.
+func LeastInUse() ReplicaSelector {
+	return func(replicas []sql.DB) sql.DB {
+		selected, least := replicas[0], replicas[0].Stats().InUse
+		for _, replica := range replicas[1:] {
+			if inUse := replica.Stats().InUse; inUse < least {
+				selected, least = replica, inUse
+			}
+		}
+		return selected
+	}
+}
+
+// Consistency is the read consistency of ReplicaDB for the reads after the
+// writes in the same session.
+type Consistency int
+
+const (
+	// Eventual sends the reads to the replicas regardless of the writes, so
+	// the reads may return stale data if the replicas lag.
+	Eventual Consistency = iota
+	// Sticky sends the reads to the primary for StickyDuration after a write.
+	Sticky
+	// GTID records the GTID executed set of the primary after a write, and
+	// waits for the replica to execute it before a read. The read is sent to
+	// the primary if the wait fails or times out. The set is queried with
+	// SELECT @@GLOBAL.gtid_executed after every write, which costs a round
+	// trip, and it includes the writes of the other sessions, so a read may
+	// wait for more than the writes of its session, but never for less.
+	GTID
+)
+
+// Session carries the state of the writes in a context, which is used by the
+// ReplicaDB for read-your-writes consistency.
+type Session struct {
+	mu        sync.Mutex
+	lastWrite time.Time
+	gtidSet   string
+	// unknown is set if the GTID executed set of the last write is unknown,
+	// then the reads are always sent to the primary.
+	unknown bool
+}
+
+type sessionKey struct{}
+
+// WithSession returns a context carrying a new Session, unless the context
+// already carries one. The writes and reads with the returned context and its
+// children belong to the same session.
+func WithSession(ctx context.Context) context.Context {
+	if sessionFrom(ctx) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, sessionKey{}, &Session{})
+}
+
+func sessionFrom(ctx context.Context) *Session {
+	session, _ := ctx.Value(sessionKey{}).(*Session)
+	return session
+}
+
+type primaryKey struct{}
+
+// WithPrimary forces the calls with the returned context to the primary.
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+func isPrimaryForced(ctx context.Context) bool {
+	forced, _ := ctx.Value(primaryKey{}).(bool)
+	return forced
+}
+
+// ReplicaDB splits the reads and the writes. The embedded DB is the primary, and
+// the plain SELECT queries and statements are sent to the replicas, while
+// everything else, including the locking reads, the transactions and the
+// dedicated connections, is sent to the primary. The context-less methods are
+// routed to the context variants with context.Background().
+//
+// The reads are only consistent with the writes in the same session, see
+// Consistency and WithSession. The writes with a dedicated connection are not
+// seen by the session.
+//
+// The replicas are ejected if they fail to ping for FailureThreshold times in a
+// row, and are admitted again after a successful ping. The pings are made by
+// CheckHealth or MonitorHealth. All the queries are sent to the primary if no
+// replica is healthy.
+type ReplicaDB struct {
+	sql.DB
+	Replicas []sql.DB
+	// Selector selects a replica for each read. RoundRobin is used if it is
+	// nil.
+	Selector ReplicaSelector
+	// FailureThreshold is the number of ping failures in a row to eject a
+	// replica. 1 is used if it is 0.
+	FailureThreshold int
+	// Consistency is the read consistency within a session.
+	Consistency Consistency
+	// StickyDuration is the duration to send the reads to the primary after a
+	// write with the Sticky consistency.
+	StickyDuration time.Duration
+	// GTIDWaitTimeout is the max time to wait for a replica with the GTID
+	// consistency. DefaultGTIDWaitTimeout is used if it is 0.
+	GTIDWaitTimeout time.Duration
+
+	once     sync.Once
+	selector ReplicaSelector
+	mu       sync.RWMutex
+	failures []int
+}
+
+// NewReplicaDB returns a middleware which wraps the primary DB with a ReplicaDB
+// of the replicas.
+func NewReplicaDB(replicas ...sql.DB) sql.Middleware {
+	return func(primary sql.DB) sql.DB {
+		return &ReplicaDB{DB: primary, Replicas: replicas}
+	}
+}
+
+// Unwrap returns the primary DB.
+func (r *ReplicaDB) Unwrap() sql.DB {
+	return r.DB
+}
+
+// isRead reports whether the query is a read-only SELECT, i.e. not a locking
+// read.
+func isRead(query string) bool {
+	info := sqlparse.Classify(query)
+	return info.Type == sqlparse.Select && info.ReadOnly
+}
+
+// healthy returns the healthy replicas.
+func (r *ReplicaDB) healthy() []sql.DB {
+	threshold := r.FailureThreshold
+	if threshold <= 0 {
+		threshold = 1
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	replicas := make([]sql.DB, 0, len(r.Replicas))
+	for i, replica := range r.Replicas {
+		if i >= len(r.failures) || r.failures[i] < threshold {
+			replicas = append(replicas, replica)
+		}
+	}
+	return replicas
+}
+
+// route returns the DB to send the query to.
+func (r *ReplicaDB) route(ctx context.Context, query string) sql.DB {
+	if !isRead(query) {
+		return r.DB
+	}
+	return r.routeRead(ctx)
+}
+
+// routeRead returns the DB to send a read to.
+func (r *ReplicaDB) routeRead(ctx context.Context) sql.DB {
+	if isPrimaryForced(ctx) {
+		return r.DB
+	}
+	replicas := r.healthy()
+	if len(replicas) == 0 {
+		return r.DB
+	}
+	r.once.Do(func() {
+		r.selector = r.Selector
+		if r.selector == nil {
+			r.selector = RoundRobin()
+		}
+	})
+	replica := r.selector(replicas)
+	if session := sessionFrom(ctx); session != nil && !r.consistent(ctx, session, replica) {
+		return r.DB
+	}
+	return replica
+}
+
+// consistent reports whether the replica has seen the writes of the session.
+func (r *ReplicaDB) consistent(ctx context.Context, session *Session, replica sql.DB) bool {
+	session.mu.Lock()
+	lastWrite, gtidSet, unknown := session.lastWrite, session.gtidSet, session.unknown
+	session.mu.Unlock()
+	switch r.Consistency {
+	case Sticky:
+		return time.Since(lastWrite) >= r.StickyDuration
+	case GTID:
+		if unknown {
+			return false
+		}
+		if gtidSet == "" {
+			return true
+		}
+		timeout := r.GTIDWaitTimeout
+		if timeout <= 0 {
+			timeout = DefaultGTIDWaitTimeout
+		}
+		var timedOut int
+		err := replica.QueryRowContext(ctx, "SELECT WAIT_FOR_EXECUTED_GTID_SET(?, ?)", gtidSet, timeout.Seconds()).Scan(&timedOut)
+		return err == nil && timedOut == 0
+	default:
+		return true
+	}
+}
+
+// recordWrite records a successful write on the primary in the session.
+func (r *ReplicaDB) recordWrite(ctx context.Context) {
+	session := sessionFrom(ctx)
+	if session == nil {
+		return
+	}
+	switch r.Consistency {
+	case Sticky:
+		session.mu.Lock()
+		session.lastWrite = time.Now()
+		session.mu.Unlock()
+	case GTID:
+		var gtidSet string
+		err := r.DB.QueryRowContext(ctx, "SELECT @@GLOBAL.gtid_executed").Scan(&gtidSet)
+		session.mu.Lock()
+		session.gtidSet, session.unknown = gtidSet, err != nil
+		session.mu.Unlock()
+	}
+}
+
+// CheckHealth pings all the replicas once, and ejects or admits them according
+// to the results.
+func (r *ReplicaDB) CheckHealth(ctx context.Context) {
+	errs := make([]error, len(r.Replicas))
+	var wg sync.WaitGroup
+	for i, replica := range r.Replicas {
+		wg.Add(1)
+		go func(i int, replica sql.DB) {
+			defer wg.Done()
+			errs[i] = replica.PingContext(ctx)
+		}(i, replica)
+	}
+	wg.Wait()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.failures) != len(r.Replicas) {
+		r.failures = make([]int, len(r.Replicas))
+	}
+	for i, err := range errs {
+		if err != nil {
+			r.failures[i]++
+		} else {
+			r.failures[i] = 0
+		}
+	}
+}
+
+// MonitorHealth calls CheckHealth at the interval until the context is done.
+func (r *ReplicaDB) MonitorHealth(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		r.CheckHealth(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *ReplicaDB) Close() error {
+	err := r.DB.Close()
+	for _, replica := range r.Replicas {
+		if e := replica.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (r *ReplicaDB) SetMaxIdleConns(n int) {
+	r.DB.SetMaxIdleConns(n)
+	for _, replica := range r.Replicas {
+		replica.SetMaxIdleConns(n)
+	}
+}
+
+func (r *ReplicaDB) SetMaxOpenConns(n int) {
+	r.DB.SetMaxOpenConns(n)
+	for _, replica := range r.Replicas {
+		replica.SetMaxOpenConns(n)
+	}
+}
+
+func (r *ReplicaDB) SetConnMaxLifetime(d time.Duration) {
+	r.DB.SetConnMaxLifetime(d)
+	for _, replica := range r.Replicas {
+		replica.SetConnMaxLifetime(d)
+	}
+}
+
+func (r *ReplicaDB) SetConnMaxIdleTime(d time.Duration) {
+	r.DB.SetConnMaxIdleTime(d)
+	for _, replica := range r.Replicas {
+		replica.SetConnMaxIdleTime(d)
+	}
+}
+
+// PrepareContext prepares the statement on the primary, unless it is a read.
+// A read statement is routed at every execution like the queries, and is
+// prepared lazily on each DB it is sent to, so a long-lived statement, such as
+// the one cached by CacheDB, still follows the replica selection, the health
+// of the replicas, the consistency and WithPrimary.
+func (r *ReplicaDB) PrepareContext(ctx context.Context, query string) (sql.Stmt, error) {
+	read := isRead(query)
+	if read && len(r.Replicas) > 0 {
+		stmt := &replicaReadStmt{db: r, query: query, stmts: make(map[sql.DB]sql.Stmt)}
+		// The statement is prepared once now, so the errors of the query are
+		// returned here.
+		_, err := stmt.stmt(ctx)
+		return stmt, err
+	}
+	stmt, err := r.DB.PrepareContext(ctx, query)
+	if read || r.Consistency == Eventual {
+		return stmt, err
+	}
+	return &replicaStmt{stmt, r}, err
+}
+
+func (r *ReplicaDB) Prepare(query string) (sql.Stmt, error) {
+	return r.PrepareContext(context.Background(), query)
+}
+
+func (r *ReplicaDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	result, err := r.DB.ExecContext(ctx, query, args...)
+	if err == nil {
+		r.recordWrite(ctx)
+	}
+	return result, err
+}
+
+func (r *ReplicaDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return r.ExecContext(context.Background(), query, args...)
+}
+
+// QueryContext sends the query to the primary and records the write if it is
+// not a read, such as CALL or INSERT ... RETURNING.
+func (r *ReplicaDB) QueryContext(ctx context.Context, query string, args ...interface{}) (sql.Rows, error) {
+	if isRead(query) {
+		return r.routeRead(ctx).QueryContext(ctx, query, args...)
+	}
+	rows, err := r.DB.QueryContext(ctx, query, args...)
+	if err == nil {
+		r.recordWrite(ctx)
+	}
+	return rows, err
+}
+
+func (r *ReplicaDB) Query(query string, args ...interface{}) (sql.Rows, error) {
+	return r.QueryContext(context.Background(), query, args...)
+}
+
+// QueryRowContext sends the query to the primary and records the write if it
+// is not a read, like QueryContext.
+func (r *ReplicaDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) sql.Row {
+	if isRead(query) {
+		return r.routeRead(ctx).QueryRowContext(ctx, query, args...)
+	}
+	row := r.DB.QueryRowContext(ctx, query, args...)
+	if row.Err() == nil {
+		r.recordWrite(ctx)
+	}
+	return row
+}
+
+func (r *ReplicaDB) QueryRow(query string, args ...interface{}) sql.Row {
+	return r.QueryRowContext(context.Background(), query, args...)
+}
+
+func (r *ReplicaDB) BeginTx(ctx context.Context, opts *stdSql.TxOptions) (sql.Tx, error) {
+	tx, err := r.DB.BeginTx(ctx, opts)
+	if r.Consistency == Eventual {
+		return tx, err
+	}
+	return &replicaTx{tx, r, ctx}, err
+}
+
+func (r *ReplicaDB) Begin() (sql.Tx, error) {
+	return r.BeginTx(context.Background(), nil)
+}
+
+// replicaStmt records the writes of a statement prepared on the primary, which
+// is never a read.
+type replicaStmt struct {
+	sql.Stmt
+	db *ReplicaDB
+}
+
+func (s *replicaStmt) Unwrap() sql.Stmt {
+	return s.Stmt
+}
+
+func (s *replicaStmt) ExecContext(ctx context.Context, args ...interface{}) (sql.Result, error) {
+	result, err := s.Stmt.ExecContext(ctx, args...)
+	if err == nil {
+		s.db.recordWrite(ctx)
+	}
+	return result, err
+}
+
+func (s *replicaStmt) Exec(args ...interface{}) (sql.Result, error) {
+	return s.ExecContext(context.Background(), args...)
+}
+
+func (s *replicaStmt) QueryContext(ctx context.Context, args ...interface{}) (sql.Rows, error) {
+	rows, err := s.Stmt.QueryContext(ctx, args...)
+	if err == nil {
+		s.db.recordWrite(ctx)
+	}
+	return rows, err
+}
+
+func (s *replicaStmt) Query(args ...interface{}) (sql.Rows, error) {
+	return s.QueryContext(context.Background(), args...)
+}
+
+func (s *replicaStmt) QueryRowContext(ctx context.Context, args ...interface{}) sql.Row {
+	row := s.Stmt.QueryRowContext(ctx, args...)
+	if row.Err() == nil {
+		s.db.recordWrite(ctx)
+	}
+	return row
+}
+
+func (s *replicaStmt) QueryRow(args ...interface{}) sql.Row {
+	return s.QueryRowContext(context.Background(), args...)
+}
+
+// replicaTx records the commit of a transaction with the context passed to
+// BeginTx.
+type replicaTx struct {
+	sql.Tx
+	db  *ReplicaDB
+	ctx context.Context
+}
+
+func (t *replicaTx) Unwrap() sql.Tx {
+	return t.Tx
+}
+
+func (t *replicaTx) Commit() error {
+	err := t.Tx.Commit()
+	if err == nil {
+		t.db.recordWrite(t.ctx)
+	}
+	return err
+}
+
+// errStmtClosed is returned by the executions of a closed replicaReadStmt.
+var errStmtClosed = errors.New("sql: statement is closed")
+
+// replicaReadStmt routes a read statement at every execution, and prepares it
+// on each DB it is sent to for the first time. The lock is never held during
+// a network call.
+type replicaReadStmt struct {
+	db     *ReplicaDB
+	query  string
+	mu     sync.Mutex
+	stmts  map[sql.DB]sql.Stmt
+	origin sql.Stmt
+	closed bool
+}
+
+// stmt returns the statement prepared on the DB routed by the context.
+func (s *replicaReadStmt) stmt(ctx context.Context) (sql.Stmt, error) {
+	db := s.db.routeRead(ctx)
+	s.mu.Lock()
+	stmt, ok := s.stmts[db]
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return nil, errStmtClosed
+	}
+	if ok {
+		return stmt, nil
+	}
+	stmt, err := db.PrepareContext(ctx, s.query)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		_ = stmt.Close()
+		return nil, errStmtClosed
+	}
+	if prepared, ok := s.stmts[db]; ok {
+		_ = stmt.Close()
+		return prepared, nil
+	}
+	s.stmts[db] = stmt
+	if s.origin == nil {
+		s.origin = stmt
+	}
+	return stmt, nil
+}
+
+func (s *replicaReadStmt) ExecContext(ctx context.Context, args ...interface{}) (sql.Result, error) {
+	stmt, err := s.stmt(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.ExecContext(ctx, args...)
+}
+
+func (s *replicaReadStmt) Exec(args ...interface{}) (sql.Result, error) {
+	return s.ExecContext(context.Background(), args...)
+}
+
+func (s *replicaReadStmt) QueryContext(ctx context.Context, args ...interface{}) (sql.Rows, error) {
+	stmt, err := s.stmt(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.QueryContext(ctx, args...)
+}
+
+func (s *replicaReadStmt) Query(args ...interface{}) (sql.Rows, error) {
+	return s.QueryContext(context.Background(), args...)
+}
+
+// QueryRowContext returns a row carrying the error if the statement is closed
+// or can't be prepared. The statement is only sent to the primary when it is
+// routed there, such as when no replica is healthy.
+func (s *replicaReadStmt) QueryRowContext(ctx context.Context, args ...interface{}) sql.Row {
+	stmt, err := s.stmt(ctx)
+	if err != nil {
+		return errRow{err}
+	}
+	return stmt.QueryRowContext(ctx, args...)
+}
+
+func (s *replicaReadStmt) QueryRow(args ...interface{}) sql.Row {
+	return s.QueryRowContext(context.Background(), args...)
+}
+
+// Close closes the statements prepared on all the DBs.
+func (s *replicaReadStmt) Close() error {
+	s.mu.Lock()
+	stmts := s.stmts
+	s.stmts, s.closed = nil, true
+	s.mu.Unlock()
+	var err error
+	for _, stmt := range stmts {
+		if e := stmt.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (s *replicaReadStmt) QueryString() string {
+	return s.query
+}
+
+// OriginStmt returns the origin of the first prepared statement, or nil if no
+// statement is prepared.
+func (s *replicaReadStmt) OriginStmt() *stdSql.Stmt {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.origin == nil {
+		return nil
+	}
+	return s.origin.OriginStmt()
+}
+
+// errRow is a row of a query which fails before it is sent.
+type errRow struct {
+	err error
+}
+
+func (r errRow) Scan(...interface{}) error {
+	return r.err
+}
+
+func (r errRow) Err() error {
+	return r.err
+}
+
+func (r errRow) OriginRow() *stdSql.Row {
+	return nil
+}
@@ -0,0 +1,201 @@
+package middleware
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	s "github.com/developerdong/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplicaDB(t *testing.T) {
+	primary, p := openFake()
+	replica, r := openFake()
+	db := s.Chain(&s.BaseDB{DB: primary}, NewReplicaDB(&s.BaseDB{DB: replica}))
+	defer func() {
+		_ = db.Close()
+	}()
+	ctx := context.Background()
+	queries := map[string]*fakeDriver{
+		"SELECT a FROM t":                    r,
+		"/* c */ select a FROM t":            r,
+		"SELECT a FROM t FOR UPDATE":         p,
+		"SELECT a FROM t LOCK IN SHARE MODE": p,
+		"UPDATE t SET a = 1":                 p,
+	}
+	for query, d := range queries {
+		var result string
+		if err := db.QueryRowContext(ctx, query).Scan(&result); err != nil {
+			t.Fatal(err)
+		}
+		if executed := d.executed(); len(executed) == 0 || executed[len(executed)-1] != query {
+			t.Errorf("%s: expected to be sent to the other DB", query)
+		}
+	}
+	var result string
+	if err := db.QueryRowContext(WithPrimary(ctx), "SELECT b FROM t").Scan(&result); err != nil {
+		t.Fatal(err)
+	}
+	if executed := p.executed(); executed[len(executed)-1] != "SELECT b FROM t" {
+		t.Error("expected the query to be forced to the primary")
+	}
+
+	r.setFail(func(string) error { return errors.New("fake") })
+	replicaDb := db.(*ReplicaDB)
+	replicaDb.CheckHealth(ctx)
+	r.setFail(nil)
+	if err := db.QueryRowContext(ctx, "SELECT c FROM t").Scan(&result); err != nil {
+		t.Fatal(err)
+	}
+	if executed := p.executed(); executed[len(executed)-1] != "SELECT c FROM t" {
+		t.Error("expected the query to be sent to the primary after the replica is ejected")
+	}
+	replicaDb.CheckHealth(ctx)
+	if err := db.QueryRowContext(ctx, "SELECT d FROM t").Scan(&result); err != nil {
+		t.Fatal(err)
+	}
+	if executed := r.executed(); executed[len(executed)-1] != "SELECT d FROM t" {
+		t.Error("expected the query to be sent to the replica after it is admitted again")
+	}
+}
+
+func TestReplicaDB_Consistency(t *testing.T) {
+	primary, p := openFake()
+	replica, r := openFake()
+	replicaDb := &ReplicaDB{DB: &s.BaseDB{DB: primary}, Replicas: []s.DB{&s.BaseDB{DB: replica}}}
+	defer func() {
+		_ = replicaDb.Close()
+	}()
+	read := func(ctx context.Context, query string) string {
+		var result string
+		if err := replicaDb.QueryRowContext(ctx, query).Scan(&result); err != nil {
+			t.Fatal(err)
+		}
+		if executed := p.executed(); len(executed) > 0 && executed[len(executed)-1] == query {
+			return "primary"
+		}
+		return "replica"
+	}
+	ctx := WithSession(context.Background())
+
+	replicaDb.Consistency = Sticky
+	replicaDb.StickyDuration = time.Hour
+	if db := read(ctx, "SELECT 1"); db != "replica" {
+		t.Fatalf("expected the read before any write to be sent to the replica, got %s", db)
+	}
+	if _, err := replicaDb.ExecContext(ctx, "UPDATE t SET a = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if db := read(ctx, "SELECT 2"); db != "primary" {
+		t.Fatalf("expected the read after a write to stick to the primary, got %s", db)
+	}
+	if db := read(context.Background(), "SELECT 3"); db != "replica" {
+		t.Fatalf("expected the read out of the session to be sent to the replica, got %s", db)
+	}
+	// The queries which are not reads are writes too.
+	ctx = WithSession(context.Background())
+	rows, err := replicaDb.QueryContext(ctx, "CALL p()")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = rows.Close()
+	if db := read(ctx, "SELECT 3"); db != "primary" {
+		t.Fatalf("expected the read after a CALL to stick to the primary, got %s", db)
+	}
+	ctx = WithSession(context.Background())
+	if err := replicaDb.QueryRowContext(ctx, "INSERT INTO t VALUES (1) RETURNING a").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if db := read(ctx, "SELECT 3"); db != "primary" {
+		t.Fatalf("expected the read after an INSERT ... RETURNING to stick to the primary, got %s", db)
+	}
+
+	ctx = WithSession(context.Background())
+	replicaDb.Consistency = GTID
+	p.setValue(func(query string) driver.Value {
+		if query == "SELECT @@GLOBAL.gtid_executed" {
+			return "uuid:1-5"
+		}
+		return query
+	})
+	waited := int64(0)
+	r.setValue(func(query string) driver.Value {
+		if strings.HasPrefix(query, "SELECT WAIT_FOR_EXECUTED_GTID_SET") {
+			return waited
+		}
+		return query
+	})
+	tx, err := replicaDb.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if db := read(ctx, "SELECT 4"); db != "replica" {
+		t.Fatalf("expected the read to be sent to the caught up replica, got %s", db)
+	}
+	waited = 1
+	if db := read(ctx, "SELECT 5"); db != "primary" {
+		t.Fatalf("expected the read to fall back to the primary, got %s", db)
+	}
+}
+
+func TestReplicaDB_Prepare(t *testing.T) {
+	primary, p := openFake()
+	replica, r := openFake()
+	db := s.Chain(&s.BaseDB{DB: primary}, NewReplicaDB(&s.BaseDB{DB: replica}))
+	defer func() {
+		_ = db.Close()
+	}()
+	ctx := context.Background()
+	stmt, err := db.PrepareContext(ctx, "SELECT a FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = stmt.Close()
+	}()
+	var result string
+	if err := stmt.QueryRowContext(ctx).Scan(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.executed()) != 1 {
+		t.Fatal("expected the statement to be sent to the replica")
+	}
+	// The statement is routed at every execution.
+	if err := stmt.QueryRowContext(WithPrimary(ctx)).Scan(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.executed()) != 1 {
+		t.Fatal("expected the statement to be forced to the primary")
+	}
+	r.setFail(func(string) error { return errors.New("fake") })
+	db.(*ReplicaDB).CheckHealth(ctx)
+	r.setFail(nil)
+	if err := stmt.QueryRowContext(ctx).Scan(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.executed()) != 2 || len(r.executed()) != 2 {
+		t.Fatal("expected the statement to be sent to the primary after the replica is ejected")
+	}
+	// The statement is prepared once on each DB.
+	if prepares := p.prepares + r.prepares; prepares != 2 {
+		t.Fatalf("expected 2 prepares, got %d", prepares)
+	}
+	if err := stmt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stmt.QueryContext(ctx); err != errStmtClosed {
+		t.Fatalf("expected %v, got %v", errStmtClosed, err)
+	}
+	// The closed statement is never sent to the primary instead.
+	if err := stmt.QueryRowContext(ctx).Scan(&result); err != errStmtClosed {
+		t.Fatalf("expected %v, got %v", errStmtClosed, err)
+	}
+	if len(p.executed()) != 2 {
+		t.Fatal("expected the closed statement not to be sent to the primary")
+	}
+}
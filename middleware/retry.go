@@ -0,0 +1,234 @@
+package middleware
+
+import (
+	"context"
+	stdSql "database/sql"
+	"github.com/developerdong/sql"
+	"github.com/developerdong/sql/backoff"
+	"github.com/developerdong/sql/mysqlerr"
+	"github.com/developerdong/sql/sqlparse"
+)
+
+var (
+	_ sql.DB   = (*RetryDB)(nil)
+	_ sql.Stmt = (*RetryStmt)(nil)
+)
+
+// DefaultMaxAttempts is the max attempts of RetryDB if MaxAttempts is 0.
+const DefaultMaxAttempts = 3
+
+type idempotentKey struct{}
+
+// WithIdempotent marks the calls with the returned context as idempotent, so
+// RetryDB retries the writes with it.
+func WithIdempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, true)
+}
+
+// IsIdempotent reports whether the context is marked by WithIdempotent.
+func IsIdempotent(ctx context.Context) bool {
+	idempotent, _ := ctx.Value(idempotentKey{}).(bool)
+	return idempotent
+}
+
+// RetryDB retries the calls failed with transient errors, such as deadlocks and
+// broken connections. The read-only statements classified by sqlparse are
+// always retried, while the others, including the writes through Query such as
+// CALL or INSERT ... RETURNING, are only retried with a context marked by
+// WithIdempotent. The statements in a
+// transaction or on a dedicated connection are never retried, because the
+// session state may be lost.
+//
+// The context-less methods are routed to the context variants with
+// context.Background().
+type RetryDB struct {
+	sql.DB
+	// MaxAttempts is the max number of attempts, including the first one.
+	// DefaultMaxAttempts is used if it is 0.
+	MaxAttempts int
+	// Backoff computes the delays between the attempts. No retry is made if
+	// the deadline of the context comes before the end of the delay.
+	Backoff backoff.Backoff
+	// Retryable reports whether an error is transient. mysqlerr.IsTransient is
+	// used if it is nil.
+	Retryable func(err error) bool
+}
+
+// NewRetryDB wraps the DB with a RetryDB. It fits the sql.Middleware type.
+func NewRetryDB(db sql.DB) sql.DB {
+	return &RetryDB{DB: db}
+}
+
+// Unwrap returns the wrapped DB.
+func (r *RetryDB) Unwrap() sql.DB {
+	return r.DB
+}
+
+// canRetry reports whether the query may be retried with the context.
+func canRetry(ctx context.Context, query string) bool {
+	return IsIdempotent(ctx) || sqlparse.Classify(query).ReadOnly
+}
+
+func (r *RetryDB) retry(ctx context.Context, f func() error) error {
+	maxAttempts := r.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+	retryable := r.Retryable
+	if retryable == nil {
+		retryable = mysqlerr.IsTransient
+	}
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= maxAttempts || !retryable(err) {
+			return err
+		}
+		if r.Backoff.Wait(ctx, attempt) != nil {
+			return err
+		}
+	}
+}
+
+func (r *RetryDB) PingContext(ctx context.Context) error {
+	return r.retry(ctx, func() error {
+		return r.DB.PingContext(ctx)
+	})
+}
+
+func (r *RetryDB) Ping() error {
+	return r.PingContext(context.Background())
+}
+
+func (r *RetryDB) PrepareContext(ctx context.Context, query string) (stmt sql.Stmt, err error) {
+	err = r.retry(ctx, func() error {
+		stmt, err = r.DB.PrepareContext(ctx, query)
+		return err
+	})
+	return &RetryStmt{stmt, r, sqlparse.Classify(query).ReadOnly}, err
+}
+
+func (r *RetryDB) Prepare(query string) (sql.Stmt, error) {
+	return r.PrepareContext(context.Background(), query)
+}
+
+func (r *RetryDB) ExecContext(ctx context.Context, query string, args ...interface{}) (result sql.Result, err error) {
+	if !canRetry(ctx, query) {
+		return r.DB.ExecContext(ctx, query, args...)
+	}
+	err = r.retry(ctx, func() error {
+		result, err = r.DB.ExecContext(ctx, query, args...)
+		return err
+	})
+	return
+}
+
+func (r *RetryDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return r.ExecContext(context.Background(), query, args...)
+}
+
+func (r *RetryDB) QueryContext(ctx context.Context, query string, args ...interface{}) (rows sql.Rows, err error) {
+	if !canRetry(ctx, query) {
+		return r.DB.QueryContext(ctx, query, args...)
+	}
+	err = r.retry(ctx, func() error {
+		rows, err = r.DB.QueryContext(ctx, query, args...)
+		return err
+	})
+	return
+}
+
+func (r *RetryDB) Query(query string, args ...interface{}) (sql.Rows, error) {
+	return r.QueryContext(context.Background(), query, args...)
+}
+
+func (r *RetryDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) (row sql.Row) {
+	if !canRetry(ctx, query) {
+		return r.DB.QueryRowContext(ctx, query, args...)
+	}
+	_ = r.retry(ctx, func() error {
+		row = r.DB.QueryRowContext(ctx, query, args...)
+		return row.Err()
+	})
+	return
+}
+
+func (r *RetryDB) QueryRow(query string, args ...interface{}) sql.Row {
+	return r.QueryRowContext(context.Background(), query, args...)
+}
+
+// BeginTx retries to begin the transaction, which is safe because nothing has
+// been done in it.
+func (r *RetryDB) BeginTx(ctx context.Context, opts *stdSql.TxOptions) (tx sql.Tx, err error) {
+	err = r.retry(ctx, func() error {
+		tx, err = r.DB.BeginTx(ctx, opts)
+		return err
+	})
+	return
+}
+
+func (r *RetryDB) Begin() (sql.Tx, error) {
+	return r.BeginTx(context.Background(), nil)
+}
+
+// RetryStmt retries the calls to the statement in the same way as RetryDB.
+type RetryStmt struct {
+	sql.Stmt
+	db *RetryDB
+	// readOnly reports whether the query of the statement is read-only.
+	readOnly bool
+}
+
+// Unwrap returns the wrapped Stmt.
+func (s *RetryStmt) Unwrap() sql.Stmt {
+	return s.Stmt
+}
+
+// canRetry reports whether the statement may be retried with the context.
+func (s *RetryStmt) canRetry(ctx context.Context) bool {
+	return s.readOnly || IsIdempotent(ctx)
+}
+
+func (s *RetryStmt) ExecContext(ctx context.Context, args ...interface{}) (result sql.Result, err error) {
+	if !s.canRetry(ctx) {
+		return s.Stmt.ExecContext(ctx, args...)
+	}
+	err = s.db.retry(ctx, func() error {
+		result, err = s.Stmt.ExecContext(ctx, args...)
+		return err
+	})
+	return
+}
+
+func (s *RetryStmt) Exec(args ...interface{}) (sql.Result, error) {
+	return s.ExecContext(context.Background(), args...)
+}
+
+func (s *RetryStmt) QueryContext(ctx context.Context, args ...interface{}) (rows sql.Rows, err error) {
+	if !s.canRetry(ctx) {
+		return s.Stmt.QueryContext(ctx, args...)
+	}
+	err = s.db.retry(ctx, func() error {
+		rows, err = s.Stmt.QueryContext(ctx, args...)
+		return err
+	})
+	return
+}
+
+func (s *RetryStmt) Query(args ...interface{}) (sql.Rows, error) {
+	return s.QueryContext(context.Background(), args...)
+}
+
+func (s *RetryStmt) QueryRowContext(ctx context.Context, args ...interface{}) (row sql.Row) {
+	if !s.canRetry(ctx) {
+		return s.Stmt.QueryRowContext(ctx, args...)
+	}
+	_ = s.db.retry(ctx, func() error {
+		row = s.Stmt.QueryRowContext(ctx, args...)
+		return row.Err()
+	})
+	return
+}
+
+func (s *RetryStmt) QueryRow(args ...interface{}) sql.Row {
+	return s.QueryRowContext(context.Background(), args...)
+}
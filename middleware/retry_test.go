@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"context"
+	s "github.com/developerdong/sql"
+	"github.com/developerdong/sql/backoff"
+	"github.com/developerdong/sql/mysqlerr"
+	"github.com/go-sql-driver/mysql"
+	"testing"
+	"time"
+)
+
+func TestRetryDB(t *testing.T) {
+	db, d := openFake()
+	defer func() {
+		_ = db.Close()
+	}()
+	retryDb := &RetryDB{DB: &s.BaseDB{DB: db}, Backoff: backoff.Backoff{Initial: time.Millisecond}}
+	failures := 0
+	d.setFail(func(string) error {
+		if failures > 0 {
+			failures--
+			return &mysql.MySQLError{Number: mysqlerr.ErLockDeadlock}
+		}
+		return nil
+	})
+	ctx := context.Background()
+	var result string
+	failures = 2
+	if err := retryDb.QueryRowContext(ctx, "SELECT 1").Scan(&result); err != nil {
+		t.Fatal(err)
+	}
+	failures = 1
+	if _, err := retryDb.ExecContext(ctx, "UPDATE t SET a = 1"); !mysqlerr.IsDeadlock(err) {
+		t.Fatalf("expected a deadlock, got %v", err)
+	}
+	failures = 1
+	if _, err := retryDb.ExecContext(WithIdempotent(ctx), "UPDATE t SET a = 1"); err != nil {
+		t.Fatal(err)
+	}
+	failures = DefaultMaxAttempts
+	if err := retryDb.QueryRowContext(ctx, "SELECT 1").Scan(&result); !mysqlerr.IsDeadlock(err) {
+		t.Fatalf("expected a deadlock, got %v", err)
+	}
+	if executed := len(d.executed()); executed != 3+1+2+DefaultMaxAttempts {
+		t.Fatalf("expected %d executions, got %d", 3+1+2+DefaultMaxAttempts, executed)
+	}
+}
+
+func TestRetryDB_QueryWrites(t *testing.T) {
+	db, d := openFake()
+	defer func() {
+		_ = db.Close()
+	}()
+	retryDb := &RetryDB{DB: &s.BaseDB{DB: db}, Backoff: backoff.Backoff{Initial: time.Millisecond}}
+	d.setFail(func(string) error {
+		return &mysql.MySQLError{Number: mysqlerr.ErLockDeadlock}
+	})
+	ctx := context.Background()
+	// The writes through Query are not retried without the idempotent mark.
+	for _, query := range []string{"CALL do_write()", "INSERT INTO t (a) VALUES (1) RETURNING id", "SELECT a FROM t FOR UPDATE"} {
+		before := len(d.executed())
+		if _, err := retryDb.QueryContext(ctx, query); !mysqlerr.IsDeadlock(err) {
+			t.Fatalf("expected a deadlock, got %v", err)
+		}
+		var result string
+		if err := retryDb.QueryRowContext(ctx, query).Scan(&result); !mysqlerr.IsDeadlock(err) {
+			t.Fatalf("expected a deadlock, got %v", err)
+		}
+		stmt, err := retryDb.PrepareContext(ctx, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stmt.QueryContext(ctx); !mysqlerr.IsDeadlock(err) {
+			t.Fatalf("expected a deadlock, got %v", err)
+		}
+		if executed := len(d.executed()) - before; executed != 3 {
+			t.Fatalf("expected %q to be executed 3 times, got %d", query, executed)
+		}
+		before = len(d.executed())
+		if _, err := retryDb.QueryContext(WithIdempotent(ctx), query); !mysqlerr.IsDeadlock(err) {
+			t.Fatalf("expected a deadlock, got %v", err)
+		}
+		if executed := len(d.executed()) - before; executed != DefaultMaxAttempts {
+			t.Fatalf("expected %q to be retried with the idempotent mark, got %d executions", query, executed)
+		}
+	}
+	stmt, err := retryDb.PrepareContext(ctx, "SELECT a FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := len(d.executed())
+	if _, err := stmt.QueryContext(ctx); !mysqlerr.IsDeadlock(err) {
+		t.Fatalf("expected a deadlock, got %v", err)
+	}
+	if executed := len(d.executed()) - before; executed != DefaultMaxAttempts {
+		t.Fatalf("expected the read to be retried, got %d executions", executed)
+	}
+}
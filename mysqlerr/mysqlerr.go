@@ -0,0 +1,72 @@
+// Package mysqlerr classifies the errors returned by the MySQL driver.
+package mysqlerr
+
+import (
+	"database/sql/driver"
+	"errors"
+	"github.com/go-sql-driver/mysql"
+)
+
+// The error numbers of the MySQL server and client.
+const (
+	ErBadFieldError      uint16 = 1054
+	ErNoSuchTable        uint16 = 1146
+	ErLockWaitTimeout    uint16 = 1205
+	ErLockDeadlock       uint16 = 1213
+	ErUnknownStmtHandler uint16 = 1243
+	ErNeedReprepare      uint16 = 1615
+	CrServerGone         uint16 = 2006
+	CrServerLost         uint16 = 2013
+)
+
+// Number returns the error number if the error is or wraps a
+// *mysql.MySQLError.
+func Number(err error) (uint16, bool) {
+	var e *mysql.MySQLError
+	if errors.As(err, &e) {
+		return e.Number, true
+	}
+	return 0, false
+}
+
+// Is reports whether the error is a *mysql.MySQLError with one of the numbers.
+func Is(err error, numbers ...uint16) bool {
+	n, ok := Number(err)
+	if !ok {
+		return false
+	}
+	for _, number := range numbers {
+		if n == number {
+			return true
+		}
+	}
+	return false
+}
+
+// IsConnectionLost reports whether the error means the connection is broken.
+func IsConnectionLost(err error) bool {
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) || Is(err, CrServerGone, CrServerLost)
+}
+
+// IsDeadlock reports whether the error is a deadlock or a lock wait timeout.
+func IsDeadlock(err error) bool {
+	return Is(err, ErLockDeadlock, ErLockWaitTimeout)
+}
+
+// IsTransient reports whether the operation failed with the error is likely to
+// succeed if it is retried.
+func IsTransient(err error) bool {
+	return IsDeadlock(err) || IsConnectionLost(err)
+}
+
+// IsSchemaChanged reports whether the error is likely caused by a schema change,
+// such as a dropped table or column.
+func IsSchemaChanged(err error) bool {
+	return Is(err, ErBadFieldError, ErNoSuchTable)
+}
+
+// IsStmtInvalidated reports whether the error means a prepared statement can't
+// be used anymore and should be prepared again.
+func IsStmtInvalidated(err error) bool {
+	return Is(err, ErUnknownStmtHandler, ErNeedReprepare) || IsConnectionLost(err) || IsSchemaChanged(err)
+}
@@ -0,0 +1,53 @@
+package mysqlerr
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"testing"
+)
+
+func TestIsTransient(t *testing.T) {
+	cases := []struct {
+		err       error
+		transient bool
+	}{
+		{driver.ErrBadConn, true},
+		{mysql.ErrInvalidConn, true},
+		{&mysql.MySQLError{Number: ErLockWaitTimeout}, true},
+		{fmt.Errorf("wrapped: %w", &mysql.MySQLError{Number: ErLockDeadlock}), true},
+		{&mysql.MySQLError{Number: CrServerGone}, true},
+		{&mysql.MySQLError{Number: CrServerLost}, true},
+		{&mysql.MySQLError{Number: 1062}, false},
+		{errors.New("other"), false},
+		{nil, false},
+	}
+	for _, c := range cases {
+		if transient := IsTransient(c.err); transient != c.transient {
+			t.Errorf("%v: expected %v, got %v", c.err, c.transient, transient)
+		}
+	}
+}
+
+func TestIsStmtInvalidated(t *testing.T) {
+	cases := []struct {
+		err         error
+		invalidated bool
+	}{
+		{driver.ErrBadConn, true},
+		{&mysql.MySQLError{Number: ErUnknownStmtHandler}, true},
+		{&mysql.MySQLError{Number: ErNeedReprepare}, true},
+		{&mysql.MySQLError{Number: ErNoSuchTable}, true},
+		{&mysql.MySQLError{Number: ErBadFieldError}, true},
+		{&mysql.MySQLError{Number: ErLockWaitTimeout}, false},
+		{&mysql.MySQLError{Number: 1062}, false},
+		{context.Canceled, false},
+	}
+	for _, c := range cases {
+		if invalidated := IsStmtInvalidated(c.err); invalidated != c.invalidated {
+			t.Errorf("%v: expected %v, got %v", c.err, c.invalidated, invalidated)
+		}
+	}
+}
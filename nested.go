@@ -0,0 +1,125 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"sync/atomic"
+)
+
+var (
+	_ Tx       = (*NestedTx)(nil)
+	_ Beginner = (DB)(nil)
+	_ Beginner = (*NestedTx)(nil)
+)
+
+// Beginner begins transactions. Both DB and NestedTx implement it, so a helper
+// taking a Beginner can be called both inside and outside a transaction.
+type Beginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (Tx, error)
+}
+
+// SavepointTx is the optional interface of the transactions which manage the
+// savepoints in their own way.
+type SavepointTx interface {
+	Savepoint(ctx context.Context, name string) error
+	RollbackTo(ctx context.Context, name string) error
+	Release(ctx context.Context, name string) error
+}
+
+// Savepoint sets a savepoint with the name in the transaction. The SAVEPOINT
+// statement is executed with the ExecContext of the Tx, so the middlewares of
+// the Tx see it, unless the Tx implements SavepointTx.
+func Savepoint(ctx context.Context, tx Tx, name string) error {
+	if s, ok := tx.(SavepointTx); ok {
+		return s.Savepoint(ctx, name)
+	}
+	_, err := tx.ExecContext(ctx, "SAVEPOINT "+quoteIdentifier(name))
+	return err
+}
+
+// RollbackToSavepoint rolls back the transaction to the savepoint with the
+// name, which is not released. It is executed like Savepoint.
+func RollbackToSavepoint(ctx context.Context, tx Tx, name string) error {
+	if s, ok := tx.(SavepointTx); ok {
+		return s.RollbackTo(ctx, name)
+	}
+	_, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+quoteIdentifier(name))
+	return err
+}
+
+// ReleaseSavepoint releases the savepoint with the name. It is executed like
+// Savepoint.
+func ReleaseSavepoint(ctx context.Context, tx Tx, name string) error {
+	if s, ok := tx.(SavepointTx); ok {
+		return s.Release(ctx, name)
+	}
+	_, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT "+quoteIdentifier(name))
+	return err
+}
+
+// NestedTx is a transaction which can be nested with savepoints. The BeginTx of
+// a NestedTx sets a savepoint in the transaction and returns a nested NestedTx,
+// whose Commit releases the savepoint and whose Rollback rolls back to the
+// savepoint. The Commit and the Rollback of the outermost NestedTx commit and
+// roll back the transaction.
+type NestedTx struct {
+	Tx
+	savepoint string
+	seq       *int64
+	done      int32
+}
+
+// NewNestedTx wraps the Tx with the outermost NestedTx.
+func NewNestedTx(tx Tx) *NestedTx {
+	return &NestedTx{Tx: tx, seq: new(int64)}
+}
+
+// Unwrap returns the wrapped Tx.
+func (n *NestedTx) Unwrap() Tx {
+	return n.Tx
+}
+
+// BeginTx sets a savepoint and returns a NestedTx of it. The options are
+// ignored, because a savepoint always inherits the options of the transaction.
+func (n *NestedTx) BeginTx(ctx context.Context, _ *sql.TxOptions) (Tx, error) {
+	if atomic.LoadInt32(&n.done) != 0 {
+		return nil, sql.ErrTxDone
+	}
+	name := "sp_" + strconv.FormatInt(atomic.AddInt64(n.seq, 1), 10)
+	if err := Savepoint(ctx, n.Tx, name); err != nil {
+		return nil, err
+	}
+	return &NestedTx{Tx: n.Tx, savepoint: name, seq: n.seq}, nil
+}
+
+func (n *NestedTx) Begin() (Tx, error) {
+	return n.BeginTx(context.Background(), nil)
+}
+
+// Commit commits the transaction, or releases the savepoint if the NestedTx is
+// nested.
+func (n *NestedTx) Commit() error {
+	if !atomic.CompareAndSwapInt32(&n.done, 0, 1) {
+		return sql.ErrTxDone
+	}
+	if n.savepoint == "" {
+		return n.Tx.Commit()
+	}
+	return ReleaseSavepoint(context.Background(), n.Tx, n.savepoint)
+}
+
+// Rollback rolls back the transaction, or rolls back to and releases the
+// savepoint if the NestedTx is nested.
+func (n *NestedTx) Rollback() error {
+	if !atomic.CompareAndSwapInt32(&n.done, 0, 1) {
+		return sql.ErrTxDone
+	}
+	if n.savepoint == "" {
+		return n.Tx.Rollback()
+	}
+	if err := RollbackToSavepoint(context.Background(), n.Tx, n.savepoint); err != nil {
+		return err
+	}
+	return ReleaseSavepoint(context.Background(), n.Tx, n.savepoint)
+}
@@ -0,0 +1,77 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+func TestNestedTx(t *testing.T) {
+	db := &recordDB{}
+	ctx := context.Background()
+	begin := func(b Beginner) Tx {
+		tx, err := b.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+	raw := begin(db)
+	tx := NewNestedTx(raw)
+	inner := begin(tx)
+	innermost := begin(inner.(Beginner))
+	if err := innermost.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := inner.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := inner.Rollback(); err != sql.ErrTxDone {
+		t.Fatalf("expected %v, got %v", sql.ErrTxDone, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "BEGIN SAVEPOINT sp_1 SAVEPOINT sp_2 RELEASE sp_2 ROLLBACK TO sp_1 RELEASE sp_1 COMMIT"
+	if ops := strings.Join(db.ops, " "); ops != expected {
+		t.Fatalf("expected %s, got %s", expected, ops)
+	}
+}
+
+// execTx records the queries executed in the transaction, and doesn't
+// implement SavepointTx.
+type execTx struct {
+	Tx
+	queries []string
+}
+
+func (e *execTx) ExecContext(_ context.Context, query string, _ ...interface{}) (Result, error) {
+	e.queries = append(e.queries, query)
+	return nil, nil
+}
+
+func (e *execTx) Commit() error {
+	return nil
+}
+
+func TestNestedTx_Exec(t *testing.T) {
+	raw := &execTx{}
+	tx := NewNestedTx(raw)
+	inner, err := tx.BeginTx(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inner.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// The savepoints are executed with the ExecContext of the Tx, so the
+	// middlewares of the Tx see them.
+	expected := "SAVEPOINT `sp_1`; ROLLBACK TO SAVEPOINT `sp_1`; RELEASE SAVEPOINT `sp_1`"
+	if queries := strings.Join(raw.queries, "; "); queries != expected {
+		t.Fatalf("expected %s, got %s", expected, queries)
+	}
+}
@@ -0,0 +1,375 @@
+// Package redact redacts the arguments of the queries before they are logged,
+// e.g. in the spans or the logs, so no secrets or large values are shipped.
+package redact
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"github.com/developerdong/sql/fingerprint"
+	"github.com/developerdong/sql/sqlparse"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// DefaultMask is the replacement of the masked values if Mask is empty.
+const DefaultMask = "[REDACTED]"
+
+// Policy is a redaction policy of the arguments. The zero value keeps all the
+// arguments. A Policy must not be changed after the first use, and is safe to
+// be used concurrently.
+type Policy struct {
+	// DropAll drops all the arguments, except the ones of the queries whose
+	// fingerprints, as returned by fingerprint.Normalize, are in Allow.
+	DropAll bool
+	Allow   []string
+	// MaskColumns are the names of the columns whose values are masked, which
+	// are matched case-insensitively. The columns of the arguments are found
+	// from the query, such as `password = ?`, `token IN (?, ?)` and
+	// `INSERT INTO t (password) VALUES (?)`, and from the names of the
+	// sql.NamedArg.
+	MaskColumns []string
+	// MaskUnknown masks the arguments whose columns are unknown if
+	// MaskColumns is not empty, so the values of the masked columns are
+	// never logged even if their columns can't be found from the query.
+	MaskUnknown bool
+	// MaskPatterns mask the matched parts of the string and []byte values,
+	// e.g. the emails and the tokens. The pointers are dereferenced and the
+	// driver.Valuer values are converted first, like database/sql does, so
+	// a *string or a sql.NullString is masked too.
+	MaskPatterns []*regexp.Regexp
+	// MaxLength truncates the string and []byte values longer than it, which
+	// are suffixed with "..." after the truncation, after the conversion like
+	// MaskPatterns. There is no limit if it is 0.
+	MaxLength int
+	// Mask is the replacement of the masked values, DefaultMask if it is
+	// empty.
+	Mask string
+
+	once    sync.Once
+	allow   map[string]bool
+	columns map[string]bool
+}
+
+func (p *Policy) init() {
+	p.once.Do(func() {
+		p.allow = make(map[string]bool, len(p.Allow))
+		for _, fp := range p.Allow {
+			p.allow[fp] = true
+		}
+		p.columns = make(map[string]bool, len(p.MaskColumns))
+		for _, column := range p.MaskColumns {
+			p.columns[strings.ToLower(column)] = true
+		}
+	})
+}
+
+func (p *Policy) mask() string {
+	if p.Mask == "" {
+		return DefaultMask
+	}
+	return p.Mask
+}
+
+// Redact returns the redacted arguments of the query, which is nil if the
+// arguments are dropped. The arguments are never modified. A nil Policy keeps
+// all the arguments.
+func (p *Policy) Redact(query string, args []interface{}) []interface{} {
+	if p == nil || len(args) == 0 {
+		return args
+	}
+	p.init()
+	if p.DropAll && !p.allow[fingerprint.Normalize(query)] {
+		return nil
+	}
+	var columns []string
+	if len(p.columns) > 0 {
+		columns = Columns(query)
+	}
+	redacted := make([]interface{}, len(args))
+	for i, arg := range args {
+		column := ""
+		if i < len(columns) {
+			column = columns[i]
+		}
+		if named, ok := arg.(sql.NamedArg); ok {
+			if named.Name != "" {
+				column = named.Name
+			}
+			named.Value = p.value(column, named.Value)
+			redacted[i] = named
+			continue
+		}
+		redacted[i] = p.value(column, arg)
+	}
+	return redacted
+}
+
+// value redacts the value of the column, which may be empty if unknown.
+func (p *Policy) value(column string, value interface{}) interface{} {
+	if column == "" && p.MaskUnknown && len(p.columns) > 0 || column != "" && p.columns[strings.ToLower(column)] {
+		return p.mask()
+	}
+	switch v := driverValue(value).(type) {
+	case string:
+		for _, pattern := range p.MaskPatterns {
+			v = pattern.ReplaceAllLiteralString(v, p.mask())
+		}
+		if p.MaxLength > 0 && len(v) > p.MaxLength {
+			v = v[:runeStart(v, p.MaxLength)] + "..."
+		}
+		return v
+	case []byte:
+		if len(p.MaskPatterns) > 0 {
+			for _, pattern := range p.MaskPatterns {
+				v = pattern.ReplaceAllLiteral(v, []byte(p.mask()))
+			}
+		}
+		if p.MaxLength > 0 && len(v) > p.MaxLength {
+			v = append(v[:p.MaxLength:p.MaxLength], "..."...)
+		}
+		return v
+	}
+	return value
+}
+
+// maxIndirections is the max number of the pointers and the driver.Valuer
+// values driverValue goes through.
+const maxIndirections = 8
+
+// driverValue returns the value which the driver gets for the argument, which
+// is the pointed value of a pointer and the result of a driver.Valuer. A nil
+// pointer is nil, and the value is returned as is if the Valuer fails.
+func driverValue(value interface{}) interface{} {
+	for i := 0; i < maxIndirections; i++ {
+		if rv := reflect.ValueOf(value); rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				return nil
+			}
+			if _, ok := value.(driver.Valuer); !ok {
+				value = rv.Elem().Interface()
+				continue
+			}
+		}
+		valuer, ok := value.(driver.Valuer)
+		if !ok {
+			return value
+		}
+		v, err := valuer.Value()
+		if err != nil {
+			return value
+		}
+		value = v
+	}
+	return value
+}
+
+// runeStart returns the start of the rune at i, so the string is not truncated
+// in the middle of a rune.
+func runeStart(s string, i int) int {
+	for i > 0 && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return i
+}
+
+// Columns returns the names of the columns of the placeholders in the query,
+// in the order of the placeholders. The name is empty if the column of a
+// placeholder is unknown. The qualifiers of the names are removed.
+//
+// A placeholder belongs to the column compared with or assigned to the
+// expression containing it, including the arguments of the function calls in
+// the expression, such as `password = SHA2(?, 256)`, and the reversed
+// comparisons such as `? = password`. The placeholders in the VALUES of an
+// INSERT belong to the columns in the column list by position.
+func Columns(query string) []string {
+	f := columnFinder{valuesDepth: -1}
+	t := sqlparse.NewTokenizer(query)
+	for token := t.Next(); token.Type != sqlparse.EOF; token = t.Next() {
+		if token.Type == sqlparse.Comment {
+			continue
+		}
+		f.resolve(token)
+		f.token(token)
+		f.prev2, f.prev = f.prev, token
+	}
+	f.resolve(sqlparse.Token{Type: sqlparse.EOF})
+	return f.columns
+}
+
+// columnScope is the column of the expression being read at a depth.
+type columnScope struct {
+	column string
+	// inherited reports whether the column is inherited from the outer
+	// depth, e.g. by the arguments of a function call, so the commas don't
+	// end it.
+	inherited bool
+	// between reports whether the column is compared by BETWEEN, so the next
+	// AND doesn't end it.
+	between bool
+}
+
+// columnFinder finds the columns of the placeholders token by token.
+type columnFinder struct {
+	columns []string
+	// prev and prev2 are the previous two tokens.
+	prev, prev2 sqlparse.Token
+	depth       int
+	scopes      []columnScope
+	// operands are the placeholders of unknown columns in the operand being
+	// read at each depth, which belong to the column on the right if the
+	// operand is the left side of a comparison.
+	operands [][]int
+	// reversed are the placeholders on the left side of a comparison, which
+	// wait for the column on the right. candidate is the column, which is
+	// resolved if it is not followed by "(" or ".".
+	reversed  []int
+	candidate string
+	// insertColumns are the columns of an INSERT, and the values are the
+	// tuples at valuesDepth after VALUES.
+	insert        bool
+	insertColumns []string
+	collecting    bool
+	valuesDepth   int
+	position      int
+}
+
+// at returns the scope and the operand at the current depth.
+func (f *columnFinder) at() (*columnScope, *[]int) {
+	for len(f.scopes) <= f.depth {
+		f.scopes = append(f.scopes, columnScope{})
+		f.operands = append(f.operands, nil)
+	}
+	return &f.scopes[f.depth], &f.operands[f.depth]
+}
+
+// resolve resolves the reversed placeholders with the column on the right of
+// the comparison.
+func (f *columnFinder) resolve(token sqlparse.Token) {
+	if f.reversed == nil {
+		return
+	}
+	switch {
+	case f.candidate == "" && isColumn(token):
+		f.candidate = name(token)
+		return
+	case f.candidate != "" && token.IsSymbol("."):
+		// The candidate is a qualifier.
+		f.candidate = ""
+		return
+	case f.candidate != "" && !token.IsSymbol("("):
+		for _, i := range f.reversed {
+			f.columns[i] = f.candidate
+		}
+	}
+	f.reversed, f.candidate = nil, ""
+}
+
+func (f *columnFinder) token(token sqlparse.Token) {
+	scope, operand := f.at()
+	switch {
+	case token.Is("INSERT") || token.Is("REPLACE"):
+		f.insert = true
+	case token.IsSymbol("("):
+		outer := *scope
+		f.depth++
+		scope, operand = f.at()
+		*scope, *operand = columnScope{column: outer.column, inherited: outer.column != ""}, nil
+		if f.insert && f.insertColumns == nil && f.valuesDepth < 0 && f.depth == 1 {
+			f.collecting = true
+		}
+		if f.depth == f.valuesDepth {
+			f.position = 0
+		}
+	case token.IsSymbol(")"):
+		if f.collecting && f.depth == 1 {
+			f.collecting = false
+			if f.insertColumns == nil {
+				f.insertColumns = []string{}
+			}
+		}
+		if f.depth == 0 {
+			return
+		}
+		// The placeholders in the parentheses are a part of the outer
+		// operand, e.g. a function call.
+		inner := *operand
+		f.depth--
+		_, operand = f.at()
+		*operand = append(*operand, inner...)
+	case token.Is("VALUES") || token.Is("VALUE"):
+		if f.insert && f.depth == 0 {
+			f.valuesDepth = 1
+		}
+		*scope, *operand = columnScope{}, nil
+	case token.IsSymbol(","):
+		if f.depth == f.valuesDepth {
+			f.position++
+		}
+		if !scope.inherited {
+			*scope = columnScope{}
+		}
+		*operand = nil
+	case f.collecting && isColumn(token) && f.depth == 1:
+		f.insertColumns = append(f.insertColumns, name(token))
+	case token.Is("AND") && scope.between:
+		scope.between = false
+	case isComparison(token):
+		column := f.prev
+		if f.prev.Is("NOT") {
+			column = f.prev2
+		}
+		if isColumn(column) {
+			*scope = columnScope{column: name(column), between: token.Is("BETWEEN")}
+		} else if len(*operand) > 0 {
+			f.reversed = *operand
+		}
+		*operand = nil
+	case token.IsSymbol(";") || token.Type == sqlparse.Ident && endsExpression[strings.ToUpper(token.Text)]:
+		*scope, *operand = columnScope{}, nil
+	case token.Type == sqlparse.Placeholder:
+		column := scope.column
+		if column == "" && f.valuesDepth > 0 && f.depth >= f.valuesDepth && f.position < len(f.insertColumns) {
+			column = f.insertColumns[f.position]
+		}
+		if column == "" {
+			*operand = append(*operand, len(f.columns))
+		}
+		f.columns = append(f.columns, column)
+	}
+}
+
+// endsExpression are the keywords ending the expression of a column.
+var endsExpression = map[string]bool{
+	"AND": true, "OR": true, "XOR": true, "SELECT": true, "FROM": true,
+	"WHERE": true, "SET": true, "ON": true, "USING": true, "HAVING": true,
+	"BY": true, "LIMIT": true, "OFFSET": true, "CASE": true, "WHEN": true,
+	"THEN": true, "ELSE": true, "END": true, "UNION": true, "UPDATE": true,
+	"RETURNING": true,
+}
+
+// isColumn reports whether the token may be a column name.
+func isColumn(token sqlparse.Token) bool {
+	return token.Type == sqlparse.Ident || token.Type == sqlparse.QuotedIdent
+}
+
+// isComparison reports whether the token compares a column with a value, or
+// assigns a value to a column.
+func isComparison(token sqlparse.Token) bool {
+	switch token.Text {
+	case "=", "<>", "!=", "<", ">", "<=", ">=", "<=>", ":=":
+		return token.Type == sqlparse.Symbol
+	}
+	return token.Is("LIKE") || token.Is("IN") || token.Is("BETWEEN") || token.Is("REGEXP")
+}
+
+// name returns the name of the column without the quotes and the qualifiers.
+func name(token sqlparse.Token) string {
+	text := token.Text
+	if token.Type == sqlparse.QuotedIdent {
+		text = strings.ReplaceAll(strings.Trim(text, "`"), "``", "`")
+	}
+	return text
+}
@@ -0,0 +1,118 @@
+package redact
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestColumns(t *testing.T) {
+	cases := []struct {
+		query   string
+		columns []string
+	}{
+		{"SELECT * FROM users WHERE u.password = ? AND `token` IN (?, ?) AND age > ? + 1", []string{"password", "token", "token", "age"}},
+		{"INSERT INTO users (name, password) VALUES (?, ?), (?, ?)", []string{"name", "password", "name", "password"}},
+		{"INSERT INTO users VALUES (?, ?) ON DUPLICATE KEY UPDATE password = ?", []string{"", "", "password"}},
+		{"UPDATE users SET password = ?, name = 'a' WHERE id = ? /* ? */", []string{"password", "id"}},
+		{"SELECT ? FROM t WHERE name LIKE ?", []string{"", "name"}},
+		{"UPDATE users SET password = SHA2(?, 256) WHERE id = ?", []string{"password", "id"}},
+		{"SELECT * FROM users WHERE password = UNHEX(?) LIMIT ?", []string{"password", ""}},
+		{"INSERT INTO users (name, password) VALUES (?, SHA2(?, 256))", []string{"name", "password"}},
+		{"SELECT * FROM users WHERE ? = password AND UNHEX(?) = `u`.`token` AND ? = LOWER(email)", []string{"password", "token", ""}},
+		{"SELECT * FROM t WHERE d BETWEEN ? AND ? AND password NOT IN (?, CONCAT(?, ?))", []string{"d", "d", "password", "password", "password"}},
+	}
+	for _, c := range cases {
+		if columns := Columns(c.query); !reflect.DeepEqual(columns, c.columns) {
+			t.Errorf("%q: expected %q, got %q", c.query, c.columns, columns)
+		}
+	}
+}
+
+func TestPolicy_Redact(t *testing.T) {
+	policy := &Policy{
+		MaskColumns:  []string{"PASSWORD"},
+		MaskPatterns: []*regexp.Regexp{regexp.MustCompile(`[a-z]+@example\.com`)},
+		MaxLength:    8,
+	}
+	query := "INSERT INTO users (email, password, bio, avatar, age) VALUES (?, ?, ?, ?, ?)"
+	args := []interface{}{"me@example.com", "secret", "héllo world", []byte("0123456789"), 42}
+	expected := []interface{}{"[REDACTE...", "[REDACTED]", "héllo w...", []byte("01234567..."), 42}
+	if redacted := policy.Redact(query, args); !reflect.DeepEqual(redacted, expected) {
+		t.Fatalf("expected %q, got %q", expected, redacted)
+	}
+	if args[0] != "me@example.com" || string(args[3].([]byte)) != "0123456789" {
+		t.Fatalf("expected the arguments not to be modified, got %q", args)
+	}
+	named := policy.Redact("SELECT * FROM users WHERE id = ?", []interface{}{sql.Named("password", "secret")})
+	if expected := []interface{}{sql.Named("password", "[REDACTED]")}; !reflect.DeepEqual(named, expected) {
+		t.Fatalf("expected %v, got %v", expected, named)
+	}
+}
+
+// blob is a driver.Valuer of bytes.
+type blob string
+
+func (b blob) Value() (driver.Value, error) {
+	return []byte(b), nil
+}
+
+func TestPolicy_Valuer(t *testing.T) {
+	policy := &Policy{
+		MaskPatterns: []*regexp.Regexp{regexp.MustCompile(`[a-z]+@example\.com`)},
+		MaxLength:    8,
+	}
+	email := "me@example.com"
+	args := []interface{}{
+		&email,
+		sql.NullString{String: email, Valid: true},
+		&sql.NullString{String: email, Valid: true},
+		blob("0123456789"),
+		(*string)(nil),
+		sql.NullString{},
+	}
+	expected := []interface{}{"[REDACTE...", "[REDACTE...", "[REDACTE...", []byte("01234567..."), (*string)(nil), sql.NullString{}}
+	if redacted := policy.Redact("SELECT ?, ?, ?, ?, ?, ?", args); !reflect.DeepEqual(redacted, expected) {
+		t.Fatalf("expected %q, got %q", expected, redacted)
+	}
+	if email != "me@example.com" {
+		t.Fatalf("expected the pointed value not to be modified, got %q", email)
+	}
+}
+
+func TestPolicy_MaskColumns(t *testing.T) {
+	policy := &Policy{MaskColumns: []string{"password"}}
+	for query, args := range map[string][]interface{}{
+		"UPDATE users SET password = SHA2(?, 256) WHERE id = ?":     {"hunter2", 1},
+		"SELECT * FROM users WHERE password = UNHEX(?) AND id = ?":  {"hunter2", 1},
+		"INSERT INTO users (password, id) VALUES (SHA2(?, 256), ?)": {"hunter2", 1},
+		"SELECT * FROM users WHERE ? = password AND id = ?":         {"hunter2", 1},
+	} {
+		expected := []interface{}{DefaultMask, 1}
+		if redacted := policy.Redact(query, args); !reflect.DeepEqual(redacted, expected) {
+			t.Errorf("%q: expected %q, got %q", query, expected, redacted)
+		}
+	}
+	policy = &Policy{MaskColumns: []string{"password"}, MaskUnknown: true}
+	query := "SELECT * FROM users WHERE CONCAT(a, b) = ? AND id = ?"
+	expected := []interface{}{DefaultMask, 1}
+	if redacted := policy.Redact(query, []interface{}{"hunter2", 1}); !reflect.DeepEqual(redacted, expected) {
+		t.Fatalf("expected %q, got %q", expected, redacted)
+	}
+}
+
+func TestPolicy_DropAll(t *testing.T) {
+	policy := &Policy{DropAll: true, Allow: []string{"select * from t where id = ?"}}
+	if redacted := policy.Redact("SELECT * FROM t WHERE id = 1 AND id = ?", []interface{}{1}); redacted != nil {
+		t.Fatalf("expected the arguments to be dropped, got %v", redacted)
+	}
+	if redacted := policy.Redact("SELECT * FROM t WHERE id = ?", []interface{}{1}); !reflect.DeepEqual(redacted, []interface{}{1}) {
+		t.Fatalf("expected the arguments to be kept, got %v", redacted)
+	}
+	var nilPolicy *Policy
+	if redacted := nilPolicy.Redact("SELECT ?", []interface{}{1}); !reflect.DeepEqual(redacted, []interface{}{1}) {
+		t.Fatalf("expected the arguments to be kept, got %v", redacted)
+	}
+}
@@ -0,0 +1,394 @@
+package sqlparse
+
+import (
+	"strings"
+)
+
+// StatementType is the type of a statement.
+type StatementType int
+
+const (
+	// Unknown is a statement of any other type.
+	Unknown StatementType = iota
+	Select
+	Insert
+	Update
+	Delete
+	Replace
+	// DDL is a CREATE, ALTER, DROP, TRUNCATE or RENAME statement.
+	DDL
+	// Show is a SHOW, DESCRIBE or EXPLAIN statement.
+	Show
+	Set
+	// Transaction is a BEGIN, START TRANSACTION, COMMIT, ROLLBACK, SAVEPOINT
+	// or RELEASE SAVEPOINT statement.
+	Transaction
+	Call
+)
+
+var statementTypeNames = [...]string{
+	Unknown:     "UNKNOWN",
+	Select:      "SELECT",
+	Insert:      "INSERT",
+	Update:      "UPDATE",
+	Delete:      "DELETE",
+	Replace:     "REPLACE",
+	DDL:         "DDL",
+	Show:        "SHOW",
+	Set:         "SET",
+	Transaction: "TRANSACTION",
+	Call:        "CALL",
+}
+
+func (t StatementType) String() string {
+	if t < 0 || int(t) >= len(statementTypeNames) {
+		return statementTypeNames[Unknown]
+	}
+	return statementTypeNames[t]
+}
+
+// StatementInfo is the information of a statement got by Classify.
+type StatementInfo struct {
+	Type StatementType
+	// ReadOnly reports whether the statement never writes, which is a SELECT
+	// without a locking clause or INTO, or a SHOW statement. It is false if
+	// the query has multiple statements.
+	ReadOnly bool
+	// Locking reports whether the statement has a locking read, i.e. FOR
+	// UPDATE, FOR SHARE or LOCK IN SHARE MODE.
+	Locking bool
+	// Tables is the names of the tables in the statement and its subqueries
+	// in the order of their first appearance, without the quotes. The names
+	// qualified by the databases are joined by a dot.
+	Tables []string
+	// HasWhere reports whether the statement has a WHERE clause, which does
+	// not count the ones in the subqueries.
+	HasWhere bool
+	// HasLimit reports whether the statement has a LIMIT clause, which does
+	// not count the ones in the subqueries.
+	HasLimit bool
+	// Multiple reports whether the query has more than one statement, where
+	// only the first one is classified.
+	Multiple bool
+}
+
+// Classify classifies the first statement of the query. The classification is
+// lexical, so it may be inaccurate for an unusual statement.
+func Classify(query string) StatementInfo {
+	var queries [8]bool
+	c := classifier{stmtDepth: -1, queries: append(queries[:0], true)}
+	t := Tokenizer{query: query}
+	for token := t.Next(); token.Type != EOF; token = t.Next() {
+		if token.Type == Comment {
+			continue
+		}
+		if c.ended {
+			c.info.Multiple = true
+			break
+		}
+		kw := keywordOf(token)
+		if !c.table(token, kw) {
+			c.token(token, kw)
+		}
+		c.prev2, c.prev = c.prev, kw
+		if token.IsSymbol("(") {
+			c.prev = "("
+		}
+	}
+	if c.state == inTable || c.state == expectPart {
+		c.addTable()
+	}
+	switch c.info.Type {
+	case Select:
+		c.info.ReadOnly = !c.info.Locking && !c.into && !c.info.Multiple
+	case Show:
+		c.info.ReadOnly = !c.info.Multiple
+	}
+	return c.info
+}
+
+// states of the table names in classifier.
+const (
+	// noTable is not in a list of the tables.
+	noTable = iota
+	// expectTable expects a table name.
+	expectTable
+	// inTable is after a part of a table name.
+	inTable
+	// expectPart expects the next part of a qualified table name after a dot.
+	expectPart
+	// afterTable is after a table name, which may be followed by an alias
+	// and the next table in the list.
+	afterTable
+	// expectAlias expects an alias after AS.
+	expectAlias
+	// afterAlias is after an alias, which may be followed by the next table
+	// in the list.
+	afterAlias
+)
+
+// classifier is the state of Classify.
+type classifier struct {
+	info StatementInfo
+	// prev and prev2 are the keywords of the previous two tokens, which are
+	// not comments. The keyword of an opening parenthesis is "(".
+	prev, prev2 string
+	depth       int
+	// stmtDepth is the depth of the statement keyword, or -1 before it.
+	stmtDepth int
+	// with reports whether the statement begins with WITH at the withDepth,
+	// and then the type is the one of the statement after the common table
+	// expressions.
+	with      bool
+	withDepth int
+	// queries reports whether each level of the parentheses is a query, whose
+	// FROM is followed by the tables, unlike the one of e.g. EXTRACT.
+	queries []bool
+	// into reports whether a SELECT has INTO.
+	into bool
+	// ended reports whether the first statement is ended by a semicolon.
+	ended bool
+	state int
+	name  string
+}
+
+var statementTypes = map[string]StatementType{
+	"SELECT":    Select,
+	"INSERT":    Insert,
+	"UPDATE":    Update,
+	"DELETE":    Delete,
+	"REPLACE":   Replace,
+	"CREATE":    DDL,
+	"ALTER":     DDL,
+	"DROP":      DDL,
+	"TRUNCATE":  DDL,
+	"RENAME":    DDL,
+	"SHOW":      Show,
+	"DESCRIBE":  Show,
+	"DESC":      Show,
+	"EXPLAIN":   Show,
+	"SET":       Set,
+	"BEGIN":     Transaction,
+	"START":     Transaction,
+	"COMMIT":    Transaction,
+	"ROLLBACK":  Transaction,
+	"SAVEPOINT": Transaction,
+	"RELEASE":   Transaction,
+	"CALL":      Call,
+}
+
+var (
+	// withStatements are the statements which may begin with WITH.
+	withStatements = set("SELECT", "INSERT", "UPDATE", "DELETE", "REPLACE")
+	// tableModifiers are the keywords which may come between a keyword and
+	// the table names after it.
+	tableModifiers = set(
+		"LOW_PRIORITY", "DELAYED", "HIGH_PRIORITY", "IGNORE", "QUICK", "INTO", "TABLE", "IF", "NOT", "EXISTS",
+		"LATERAL",
+	)
+	// clauseKeywords are the keywords which may follow a table name, so they
+	// are neither table names nor aliases.
+	clauseKeywords = set(
+		"WHERE", "JOIN", "INNER", "LEFT", "RIGHT", "CROSS", "NATURAL", "STRAIGHT_JOIN", "FULL", "OUTER", "ON",
+		"USING", "SET", "VALUES", "VALUE", "SELECT", "ORDER", "GROUP", "HAVING", "LIMIT", "UNION", "EXCEPT",
+		"INTERSECT", "FOR", "LOCK", "WINDOW", "PARTITION", "USE", "FORCE", "IGNORE", "INTO", "TO", "AS", "ADD",
+		"DROP", "MODIFY", "CHANGE", "RENAME", "ENGINE", "LIKE", "DEFAULT", "CHARACTER", "CHARSET", "COLLATE",
+		"COMMENT", "AUTO_INCREMENT", "WITH", "DUAL",
+	)
+	// keywords are all the keywords known by Classify.
+	keywords = make(map[string]string)
+)
+
+// maxKeywordLen is the max length of the keywords.
+const maxKeywordLen = 16
+
+func init() {
+	for keyword := range statementTypes {
+		keywords[keyword] = keyword
+	}
+	for _, set := range []map[string]bool{withStatements, tableModifiers, clauseKeywords} {
+		for keyword := range set {
+			keywords[keyword] = keyword
+		}
+	}
+	for _, keyword := range []string{"FROM", "TABLE", "REFERENCES", "INDEX", "SHARE", "MODE", "IN"} {
+		keywords[keyword] = keyword
+	}
+}
+
+func set(keywords ...string) map[string]bool {
+	m := make(map[string]bool, len(keywords))
+	for _, keyword := range keywords {
+		m[keyword] = true
+	}
+	return m
+}
+
+// keywordOf returns the uppercase keyword of the token, or "" if it is not a
+// keyword known by Classify. It does not allocate.
+func keywordOf(token Token) string {
+	if token.Type != Ident || len(token.Text) > maxKeywordLen {
+		return ""
+	}
+	var buf [maxKeywordLen]byte
+	for i := 0; i < len(token.Text); i++ {
+		c := token.Text[i]
+		if 'a' <= c && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		buf[i] = c
+	}
+	return keywords[string(buf[:len(token.Text)])]
+}
+
+// table moves the state of the table names, and reports whether the token is
+// consumed as a part of them.
+func (c *classifier) table(token Token, kw string) bool {
+	switch c.state {
+	case expectTable:
+		if tableModifiers[kw] {
+			return true
+		}
+		if token.Type == QuotedIdent || token.Type == Ident && !clauseKeywords[kw] {
+			c.name = unquote(token)
+			c.state = inTable
+			return true
+		}
+	case inTable:
+		if token.IsSymbol(".") {
+			c.state = expectPart
+			return true
+		}
+		c.addTable()
+		c.state = afterTable
+		return c.table(token, kw)
+	case expectPart:
+		if token.Type == Ident || token.Type == QuotedIdent {
+			c.name += "." + unquote(token)
+			c.state = inTable
+			return true
+		}
+		c.addTable()
+	case afterTable:
+		if kw == "AS" {
+			c.state = expectAlias
+			return true
+		}
+		if token.Type == QuotedIdent || token.Type == Ident && !clauseKeywords[kw] {
+			c.state = afterAlias
+			return true
+		}
+		fallthrough
+	case afterAlias:
+		if token.IsSymbol(",") {
+			c.state = expectTable
+			return true
+		}
+	case expectAlias:
+		c.state = afterAlias
+		return true
+	}
+	c.state = noTable
+	return false
+}
+
+func (c *classifier) addTable() {
+	for _, table := range c.info.Tables {
+		if table == c.name {
+			return
+		}
+	}
+	c.info.Tables = append(c.info.Tables, c.name)
+}
+
+// token handles the token which is not a part of the table names.
+func (c *classifier) token(token Token, kw string) {
+	switch {
+	case token.IsSymbol("("):
+		c.depth++
+		c.queries = append(c.queries, false)
+		return
+	case token.IsSymbol(")"):
+		if c.depth > 0 {
+			c.depth--
+			c.queries = c.queries[:len(c.queries)-1]
+		}
+		return
+	case token.IsSymbol(";"):
+		c.ended = c.depth == 0
+		return
+	case kw == "":
+		if c.stmtDepth < 0 && !c.with && token.Type == Ident {
+			// An unknown statement.
+			c.stmtDepth = c.depth
+		}
+		return
+	}
+	if c.prev == "(" && (kw == "SELECT" || kw == "WITH") {
+		c.queries[c.depth] = true
+	}
+	if c.stmtDepth < 0 {
+		if !c.with {
+			if kw == "WITH" {
+				c.with = true
+				c.withDepth = c.depth
+				return
+			}
+			c.begin(kw)
+			return
+		}
+		if c.depth == c.withDepth && withStatements[kw] {
+			c.begin(kw)
+			return
+		}
+	}
+	switch kw {
+	case "FROM", "JOIN":
+		if c.queries[c.depth] {
+			c.state = expectTable
+		}
+	case "INTO":
+		c.into = c.info.Type == Select
+	case "TABLE", "TO", "REFERENCES", "ON":
+		if c.info.Type == DDL && (kw != "ON" || c.prev2 == "INDEX") {
+			c.state = expectTable
+		}
+	case "UPDATE", "SHARE":
+		if c.prev == "FOR" {
+			c.info.Locking = true
+		}
+	case "MODE":
+		if c.prev == "SHARE" && c.prev2 == "IN" {
+			c.info.Locking = true
+		}
+	case "WHERE":
+		c.info.HasWhere = c.info.HasWhere || c.depth == c.stmtDepth
+	case "LIMIT":
+		c.info.HasLimit = c.info.HasLimit || c.depth == c.stmtDepth
+	}
+}
+
+// begin begins the statement with the keyword.
+func (c *classifier) begin(kw string) {
+	c.stmtDepth = c.depth
+	c.info.Type = statementTypes[kw]
+	switch kw {
+	case "INSERT", "REPLACE", "UPDATE", "TRUNCATE", "DESCRIBE", "DESC":
+		c.state = expectTable
+	}
+}
+
+// unquote returns the name of the identifier without the quotes.
+func unquote(token Token) string {
+	if token.Type != QuotedIdent {
+		return token.Text
+	}
+	name := token.Text[1:]
+	if strings.HasSuffix(name, "`") {
+		name = name[:len(name)-1]
+	}
+	if strings.Contains(name, "``") {
+		name = strings.ReplaceAll(name, "``", "`")
+	}
+	return name
+}
@@ -0,0 +1,136 @@
+package sqlparse
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	cases := []struct {
+		query string
+		info  StatementInfo
+	}{
+		{
+			"SELECT * FROM t WHERE id = ? LIMIT 1",
+			StatementInfo{Type: Select, ReadOnly: true, Tables: []string{"t"}, HasWhere: true, HasLimit: true},
+		},
+		{
+			"/* caller */ select a.x, b.y from db.a as a, `b` b join c on a.id = c.id",
+			StatementInfo{Type: Select, ReadOnly: true, Tables: []string{"db.a", "b", "c"}},
+		},
+		{
+			"SELECT * FROM t WHERE id = 1 FOR UPDATE",
+			StatementInfo{Type: Select, Locking: true, Tables: []string{"t"}, HasWhere: true},
+		},
+		{
+			"(SELECT a FROM t LOCK IN SHARE MODE)",
+			StatementInfo{Type: Select, Locking: true, Tables: []string{"t"}},
+		},
+		{
+			"SELECT 'FOR UPDATE', EXTRACT(YEAR FROM d) FROM t",
+			StatementInfo{Type: Select, ReadOnly: true, Tables: []string{"t"}},
+		},
+		{
+			"SELECT * FROM t WHERE a IN (SELECT b FROM u WHERE c = 1 LIMIT 1)",
+			StatementInfo{Type: Select, ReadOnly: true, Tables: []string{"t", "u"}, HasWhere: true},
+		},
+		{
+			"SELECT a INTO OUTFILE '/tmp/a' FROM t",
+			StatementInfo{Type: Select, Tables: []string{"t"}},
+		},
+		{
+			"WITH c AS (SELECT * FROM t WHERE a = 1) UPDATE u JOIN c ON u.id = c.id SET u.a = 2",
+			StatementInfo{Type: Update, Tables: []string{"t", "u", "c"}},
+		},
+		{
+			"INSERT IGNORE INTO t (a, b) VALUES (?, ?) ON DUPLICATE KEY UPDATE a = VALUES(a)",
+			StatementInfo{Type: Insert, Tables: []string{"t"}},
+		},
+		{
+			"REPLACE t SELECT * FROM u",
+			StatementInfo{Type: Replace, Tables: []string{"t", "u"}},
+		},
+		{
+			"UPDATE LOW_PRIORITY t SET a = (SELECT b FROM u WHERE id = 1)",
+			StatementInfo{Type: Update, Tables: []string{"t", "u"}},
+		},
+		{
+			"DELETE FROM t",
+			StatementInfo{Type: Delete, Tables: []string{"t"}},
+		},
+		{
+			"DELETE t1 FROM t1 INNER JOIN t2 ON t1.id = t2.id WHERE t2.a = 1",
+			StatementInfo{Type: Delete, Tables: []string{"t1", "t2"}, HasWhere: true},
+		},
+		{
+			"DROP TABLE IF EXISTS a, `b`",
+			StatementInfo{Type: DDL, Tables: []string{"a", "b"}},
+		},
+		{
+			"RENAME TABLE a TO b, c TO d",
+			StatementInfo{Type: DDL, Tables: []string{"a", "b", "c", "d"}},
+		},
+		{
+			"CREATE INDEX i ON t (a)",
+			StatementInfo{Type: DDL, Tables: []string{"t"}},
+		},
+		{
+			"TRUNCATE TABLE t",
+			StatementInfo{Type: DDL, Tables: []string{"t"}},
+		},
+		{
+			"SHOW TABLES",
+			StatementInfo{Type: Show, ReadOnly: true},
+		},
+		{
+			"DESC t",
+			StatementInfo{Type: Show, ReadOnly: true, Tables: []string{"t"}},
+		},
+		{
+			"SELECT 1 FROM DUAL",
+			StatementInfo{Type: Select, ReadOnly: true},
+		},
+		{
+			"SELECT 1; DELETE FROM t",
+			StatementInfo{Type: Select, Multiple: true},
+		},
+		{
+			"SET autocommit = 0",
+			StatementInfo{Type: Set},
+		},
+		{
+			"START TRANSACTION",
+			StatementInfo{Type: Transaction},
+		},
+		{
+			"/*!40101 SET NAMES utf8 */",
+			StatementInfo{Type: Set},
+		},
+		{
+			"",
+			StatementInfo{},
+		},
+	}
+	for _, c := range cases {
+		if info := Classify(c.query); !reflect.DeepEqual(info, c.info) {
+			t.Errorf("%q: expected %+v, got %+v", c.query, c.info, info)
+		}
+	}
+}
+
+func TestStatementType_String(t *testing.T) {
+	if s := Select.String(); s != "SELECT" {
+		t.Fatalf("expected SELECT, got %s", s)
+	}
+	if s := StatementType(-1).String(); s != "UNKNOWN" {
+		t.Fatalf("expected UNKNOWN, got %s", s)
+	}
+}
+
+func BenchmarkClassify(b *testing.B) {
+	query := "SELECT u.id, u.name FROM users u JOIN orders o ON o.user_id = u.id WHERE u.name = 'a' AND o.id IN (?, ?, ?) LIMIT 10"
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Classify(query)
+	}
+}
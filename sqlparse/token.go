@@ -0,0 +1,222 @@
+// Package sqlparse is a lightweight MySQL dialect tokenizer and statement
+// classifier, which is fast enough to run on every query.
+package sqlparse
+
+import (
+	"strings"
+)
+
+// TokenType is the type of a token.
+type TokenType int
+
+const (
+	// EOF is the end of the query.
+	EOF TokenType = iota
+	// Comment is a comment, including the optimizer hints /*+ ... */. The
+	// content of the executable comments /*! ... */ is tokenized as a part of
+	// the query instead.
+	Comment
+	// Ident is an unquoted identifier or keyword.
+	Ident
+	// QuotedIdent is an identifier quoted by backticks.
+	QuotedIdent
+	// String is a string literal, including the hexadecimal, bit and national
+	// ones like X'0F'. A double quoted text is a string literal in MySQL.
+	String
+	// Number is a numeric literal.
+	Number
+	// Placeholder is the placeholder ?.
+	Placeholder
+	// Variable is a user variable like @a, or a system variable like @@a.
+	Variable
+	// Symbol is an operator or punctuation, such as >=, ( and ,.
+	Symbol
+)
+
+// Token is a token of a query.
+type Token struct {
+	Type TokenType
+	// Text is the text of the token in the query, including the quotes and
+	// the comment markers.
+	Text string
+	// Pos is the byte offset of the token in the query.
+	Pos int
+}
+
+// Is reports whether the token is the keyword, case-insensitively.
+func (t Token) Is(keyword string) bool {
+	return t.Type == Ident && strings.EqualFold(t.Text, keyword)
+}
+
+// IsSymbol reports whether the token is the symbol.
+func (t Token) IsSymbol(symbol string) bool {
+	return t.Type == Symbol && t.Text == symbol
+}
+
+// Tokenizer splits a query into tokens. The whitespace between the tokens is
+// skipped. The unterminated comments and quoted texts end at the end of the
+// query.
+type Tokenizer struct {
+	query string
+	pos   int
+	// exec reports whether the tokenizer is in an executable comment.
+	exec bool
+}
+
+// NewTokenizer returns a Tokenizer of the query.
+func NewTokenizer(query string) *Tokenizer {
+	return &Tokenizer{query: query}
+}
+
+// Tokenize returns all the tokens of the query.
+func Tokenize(query string) []Token {
+	var tokens []Token
+	t := Tokenizer{query: query}
+	for token := t.Next(); token.Type != EOF; token = t.Next() {
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+// Next returns the next token, or a token of EOF at the end of the query.
+func (t *Tokenizer) Next() Token {
+	query := t.query
+	for t.pos < len(query) {
+		i := t.pos
+		c := query[i]
+		switch {
+		case IsSpace(c):
+			t.pos++
+		case t.exec && c == '*' && i+1 < len(query) && query[i+1] == '/':
+			t.exec = false
+			t.pos += 2
+		case c == '#' || c == '-' && isDashComment(query, i):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			return t.token(Comment, i+end)
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			if !t.exec && i+2 < len(query) && query[i+2] == '!' {
+				// The optional version is a part of the marker.
+				t.exec = true
+				t.pos = i + 3
+				for t.pos < len(query) && isDigit(query[t.pos]) {
+					t.pos++
+				}
+				continue
+			}
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return t.token(Comment, len(query))
+			}
+			return t.token(Comment, i+end+4)
+		case c == '\'' || c == '"':
+			return t.token(String, quoteEnd(query, i))
+		case c == '`':
+			return t.token(QuotedIdent, quoteEnd(query, i))
+		case isDigit(c) || c == '.' && i+1 < len(query) && isDigit(query[i+1]):
+			return t.token(Number, numberEnd(query, i))
+		case isIdent(c):
+			end := i + 1
+			for end < len(query) && (isIdent(query[end]) || isDigit(query[end])) {
+				end++
+			}
+			if end-i == 1 && end < len(query) && query[end] == '\'' && strings.IndexByte("xXbBnN", c) >= 0 {
+				return t.token(String, quoteEnd(query, end))
+			}
+			return t.token(Ident, end)
+		case c == '?':
+			return t.token(Placeholder, i+1)
+		case c == '@':
+			end := i + 1
+			for end < len(query) && query[end] == '@' {
+				end++
+			}
+			if end < len(query) && (query[end] == '\'' || query[end] == '"' || query[end] == '`') {
+				return t.token(Variable, quoteEnd(query, end))
+			}
+			for end < len(query) && (isIdent(query[end]) || isDigit(query[end]) || query[end] == '.') {
+				end++
+			}
+			return t.token(Variable, end)
+		case strings.IndexByte("<>=!:|&", c) >= 0:
+			end := i + 1
+			for end < len(query) && strings.IndexByte("<>=!:|&", query[end]) >= 0 {
+				end++
+			}
+			return t.token(Symbol, end)
+		default:
+			return t.token(Symbol, i+1)
+		}
+	}
+	return Token{Type: EOF, Pos: len(query)}
+}
+
+// token returns the token from the current position to the end, and moves to
+// the end.
+func (t *Tokenizer) token(typ TokenType, end int) Token {
+	token := Token{Type: typ, Text: t.query[t.pos:end], Pos: t.pos}
+	t.pos = end
+	return token
+}
+
+// quoteEnd returns the end of the quoted text starting at i. The backslash
+// escapes the next character in the string literals, and the doubled quotes
+// are part of the text.
+func quoteEnd(query string, i int) int {
+	quote := query[i]
+	for j := i + 1; j < len(query); j++ {
+		switch query[j] {
+		case '\\':
+			if quote != '`' {
+				j++
+			}
+		case quote:
+			if j+1 < len(query) && query[j+1] == quote {
+				j++
+				continue
+			}
+			return j + 1
+		}
+	}
+	return len(query)
+}
+
+// numberEnd returns the end of the number starting at i, including the
+// hexadecimal and binary ones and the exponents.
+func numberEnd(query string, i int) int {
+	for i++; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case isDigit(c) || isIdent(c) || c == '.':
+		case (c == '+' || c == '-') && (query[i-1] == 'e' || query[i-1] == 'E'):
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// isDashComment reports whether a "-- " comment starts at i. MySQL requires
+// the double dash to be followed by whitespace or a control character.
+func isDashComment(query string, i int) bool {
+	if !strings.HasPrefix(query[i:], "--") {
+		return false
+	}
+	return i+2 == len(query) || query[i+2] <= ' '
+}
+
+// IsSpace reports whether the byte is whitespace, which separates the tokens.
+func IsSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// isIdent reports whether the character can start an unquoted identifier.
+func isIdent(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_' || c == '$' || c >= 0x80
+}
@@ -0,0 +1,59 @@
+package sqlparse
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	query := "SELECT `a``b`, 'it''s', \"x\\\"y\", X'0F', 1.5e-3, @v, @@global.x /* c */ -- d\n" +
+		"FROM t WHERE a >= ? # e"
+	expected := []Token{
+		{Ident, "SELECT", 0},
+		{QuotedIdent, "`a``b`", 7},
+		{Symbol, ",", 13},
+		{String, "'it''s'", 15},
+		{Symbol, ",", 22},
+		{String, "\"x\\\"y\"", 24},
+		{Symbol, ",", 30},
+		{String, "X'0F'", 32},
+		{Symbol, ",", 37},
+		{Number, "1.5e-3", 39},
+		{Symbol, ",", 45},
+		{Variable, "@v", 47},
+		{Symbol, ",", 49},
+		{Variable, "@@global.x", 51},
+		{Comment, "/* c */", 62},
+		{Comment, "-- d", 70},
+		{Ident, "FROM", 75},
+		{Ident, "t", 80},
+		{Ident, "WHERE", 82},
+		{Ident, "a", 88},
+		{Symbol, ">=", 90},
+		{Placeholder, "?", 93},
+		{Comment, "# e", 95},
+	}
+	if tokens := Tokenize(query); !reflect.DeepEqual(tokens, expected) {
+		t.Fatalf("expected %v, got %v", expected, tokens)
+	}
+}
+
+func TestTokenize_ExecutableComment(t *testing.T) {
+	var texts []string
+	for _, token := range Tokenize("SELECT /*!40001 SQL_NO_CACHE */ * FROM t /*+ BKA(t) */") {
+		texts = append(texts, token.Text)
+	}
+	expected := []string{"SELECT", "SQL_NO_CACHE", "*", "FROM", "t", "/*+ BKA(t) */"}
+	if !reflect.DeepEqual(texts, expected) {
+		t.Fatalf("expected %q, got %q", expected, texts)
+	}
+}
+
+func TestTokenize_Unterminated(t *testing.T) {
+	for _, query := range []string{"SELECT 'a", "SELECT `a", "SELECT /* a", "SELECT /*! 1", "SELECT 1 --"} {
+		tokens := Tokenize(query)
+		if last := tokens[len(tokens)-1]; last.Pos+len(last.Text) != len(query) && last.Text != "1" {
+			t.Errorf("%q: expected the last token to end at the end, got %v", query, last)
+		}
+	}
+}
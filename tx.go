@@ -0,0 +1,78 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"github.com/developerdong/sql/backoff"
+	"github.com/developerdong/sql/mysqlerr"
+)
+
+// DefaultTxMaxAttempts is the max attempts of TxRetryPolicy if MaxAttempts is 0.
+const DefaultTxMaxAttempts = 3
+
+// TxRetryPolicy decides whether and when RunInTx re-runs a failed transaction.
+type TxRetryPolicy struct {
+	// MaxAttempts is the max number of attempts, including the first one.
+	// DefaultTxMaxAttempts is used if it is 0.
+	MaxAttempts int
+	// Backoff computes the delays between the attempts. No retry is made if
+	// the deadline of the context comes before the end of the delay.
+	Backoff backoff.Backoff
+	// Retryable reports whether the transaction failed with the error should be
+	// re-run. mysqlerr.IsDeadlock is used if it is nil.
+	Retryable func(err error) bool
+}
+
+// DefaultTxRetryPolicy is the policy used by RunInTx.
+var DefaultTxRetryPolicy = TxRetryPolicy{}
+
+// RunInTx runs the function in a transaction with DefaultTxRetryPolicy. See
+// TxRetryPolicy.RunInTx for details.
+func RunInTx(ctx context.Context, db DB, opts *sql.TxOptions, fn func(ctx context.Context, tx Tx) error) error {
+	return DefaultTxRetryPolicy.RunInTx(ctx, db, opts, fn)
+}
+
+// RunInTx begins a transaction and runs the function in it. The transaction is
+// committed if the function returns nil, or rolled back if the function returns
+// an error or panics, and the panic is re-raised after the rollback. The whole
+// transaction, including the function, is re-run if it fails with a retryable
+// error, so the function must not have side effects outside the transaction.
+func (p TxRetryPolicy) RunInTx(ctx context.Context, db DB, opts *sql.TxOptions, fn func(ctx context.Context, tx Tx) error) error {
+	maxAttempts := p.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultTxMaxAttempts
+	}
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = mysqlerr.IsDeadlock
+	}
+	for attempt := 1; ; attempt++ {
+		err := runInTx(ctx, db, opts, fn)
+		if err == nil || attempt >= maxAttempts || !retryable(err) {
+			return err
+		}
+		if p.Backoff.Wait(ctx, attempt) != nil {
+			return err
+		}
+	}
+}
+
+func runInTx(ctx context.Context, db DB, opts *sql.TxOptions, fn func(ctx context.Context, tx Tx) error) (err error) {
+	tx, err := db.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	if err = fn(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
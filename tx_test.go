@@ -0,0 +1,100 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/developerdong/sql/backoff"
+	"github.com/developerdong/sql/mysqlerr"
+	"github.com/go-sql-driver/mysql"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordDB struct {
+	DB
+	ops []string
+}
+
+func (r *recordDB) BeginTx(context.Context, *sql.TxOptions) (Tx, error) {
+	r.ops = append(r.ops, "BEGIN")
+	return &recordTx{r: r}, nil
+}
+
+type recordTx struct {
+	Tx
+	r *recordDB
+}
+
+func (r *recordTx) Commit() error {
+	r.r.ops = append(r.r.ops, "COMMIT")
+	return nil
+}
+
+func (r *recordTx) Rollback() error {
+	r.r.ops = append(r.r.ops, "ROLLBACK")
+	return nil
+}
+
+func (r *recordTx) Savepoint(_ context.Context, name string) error {
+	r.r.ops = append(r.r.ops, "SAVEPOINT "+name)
+	return nil
+}
+
+func (r *recordTx) RollbackTo(_ context.Context, name string) error {
+	r.r.ops = append(r.r.ops, "ROLLBACK TO "+name)
+	return nil
+}
+
+func (r *recordTx) Release(_ context.Context, name string) error {
+	r.r.ops = append(r.r.ops, "RELEASE "+name)
+	return nil
+}
+
+func TestRunInTx(t *testing.T) {
+	db := &recordDB{}
+	policy := TxRetryPolicy{Backoff: backoff.Backoff{Initial: time.Millisecond}}
+	deadlock := &mysql.MySQLError{Number: mysqlerr.ErLockDeadlock}
+	attempts := 0
+	err := policy.RunInTx(context.Background(), db, nil, func(ctx context.Context, tx Tx) error {
+		attempts++
+		if attempts == 1 {
+			return deadlock
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "BEGIN ROLLBACK BEGIN COMMIT"
+	if ops := strings.Join(db.ops, " "); ops != expected {
+		t.Fatalf("expected %s, got %s", expected, ops)
+	}
+
+	db.ops = nil
+	errFake := errors.New("fake")
+	if err := policy.RunInTx(context.Background(), db, nil, func(ctx context.Context, tx Tx) error {
+		return errFake
+	}); err != errFake {
+		t.Fatalf("expected %v, got %v", errFake, err)
+	}
+	if ops := strings.Join(db.ops, " "); ops != "BEGIN ROLLBACK" {
+		t.Fatalf("expected BEGIN ROLLBACK, got %s", ops)
+	}
+
+	db.ops = nil
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected the panic to be re-raised")
+			}
+		}()
+		_ = RunInTx(context.Background(), db, nil, func(ctx context.Context, tx Tx) error {
+			panic("fake")
+		})
+	}()
+	if ops := strings.Join(db.ops, " "); ops != "BEGIN ROLLBACK" {
+		t.Fatalf("expected BEGIN ROLLBACK, got %s", ops)
+	}
+}
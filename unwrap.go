@@ -0,0 +1,102 @@
+package sql
+
+import (
+	"reflect"
+)
+
+// Unwrap returns the next inner DB of the middleware, if the middleware has an
+// Unwrap method returning DB. Otherwise, it returns nil.
+func Unwrap(db DB) DB {
+	u, ok := db.(interface{ Unwrap() DB })
+	if !ok {
+		return nil
+	}
+	return u.Unwrap()
+}
+
+// UnwrapStmt is the Stmt version of Unwrap.
+func UnwrapStmt(stmt Stmt) Stmt {
+	u, ok := stmt.(interface{ Unwrap() Stmt })
+	if !ok {
+		return nil
+	}
+	return u.Unwrap()
+}
+
+// UnwrapTx is the Tx version of Unwrap.
+func UnwrapTx(tx Tx) Tx {
+	u, ok := tx.(interface{ Unwrap() Tx })
+	if !ok {
+		return nil
+	}
+	return u.Unwrap()
+}
+
+// UnwrapConn is the Conn version of Unwrap.
+func UnwrapConn(conn Conn) Conn {
+	u, ok := conn.(interface{ Unwrap() Conn })
+	if !ok {
+		return nil
+	}
+	return u.Unwrap()
+}
+
+// As finds the first middleware in the stack of the DB that matches the target,
+// and if one is found, sets the target to that middleware and returns true.
+// Otherwise, it returns false. The stack consists of the DB itself, followed by
+// the DBs obtained by repeatedly calling Unwrap.
+//
+// A middleware matches the target if it is assignable to the value pointed to
+// by the target. As panics if the target is not a non-nil pointer to either a
+// type that implements DB, or to any interface type.
+func As(db DB, target interface{}) bool {
+	return as(db, target, reflect.TypeOf((*DB)(nil)).Elem(), func(v interface{}) interface{} {
+		return Unwrap(v.(DB))
+	})
+}
+
+// AsStmt is the Stmt version of As.
+func AsStmt(stmt Stmt, target interface{}) bool {
+	return as(stmt, target, reflect.TypeOf((*Stmt)(nil)).Elem(), func(v interface{}) interface{} {
+		return UnwrapStmt(v.(Stmt))
+	})
+}
+
+// AsTx is the Tx version of As.
+func AsTx(tx Tx, target interface{}) bool {
+	return as(tx, target, reflect.TypeOf((*Tx)(nil)).Elem(), func(v interface{}) interface{} {
+		return UnwrapTx(v.(Tx))
+	})
+}
+
+// AsConn is the Conn version of As.
+func AsConn(conn Conn, target interface{}) bool {
+	return as(conn, target, reflect.TypeOf((*Conn)(nil)).Elem(), func(v interface{}) interface{} {
+		return UnwrapConn(v.(Conn))
+	})
+}
+
+// as walks the stack in the same way as errors.As. The unwrap function returns
+// nil at the bottom of the stack.
+func as(v interface{}, target interface{}, typ reflect.Type, unwrap func(interface{}) interface{}) bool {
+	if target == nil {
+		panic("sql: target cannot be nil")
+	}
+	val := reflect.ValueOf(target)
+	targetType := val.Type()
+	if targetType.Kind() != reflect.Ptr || val.IsNil() {
+		panic("sql: target must be a non-nil pointer")
+	}
+	targetType = targetType.Elem()
+	if targetType.Kind() != reflect.Interface && !targetType.Implements(typ) {
+		panic("sql: *target must be interface or implement " + typ.String())
+	}
+	for v != nil {
+		if reflect.TypeOf(v).AssignableTo(targetType) {
+			val.Elem().Set(reflect.ValueOf(v))
+			return true
+		}
+		v = unwrap(v)
+	}
+	return false
+}
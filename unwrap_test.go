@@ -0,0 +1,58 @@
+package sql
+
+import (
+	"testing"
+)
+
+func TestUnwrap(t *testing.T) {
+	base := &BaseDB{}
+	db := Chain(base, named("a"), named("b"))
+	if n := Unwrap(db).(*nameDB); n.name != "b" {
+		t.Fatalf("expected middleware b, got %s", n.name)
+	}
+	if inner := Unwrap(Unwrap(db)); inner != base {
+		t.Fatalf("expected the base DB, got %T", inner)
+	}
+	if inner := Unwrap(base); inner != nil {
+		t.Fatalf("expected nil, got %T", inner)
+	}
+}
+
+func TestAs(t *testing.T) {
+	base := &BaseDB{}
+	db := Chain(base, named("a"), named("b"))
+	var n *nameDB
+	if !As(db, &n) || n.name != "a" {
+		t.Fatal("expected to find middleware a")
+	}
+	var b *BaseDB
+	if !As(db, &b) || b != base {
+		t.Fatal("expected to find the base DB")
+	}
+	var tx *BaseTx
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic for the target not implementing DB")
+		}
+	}()
+	As(db, &tx)
+}
+
+// unwrapStmt is a Stmt middleware which only has Unwrap.
+type unwrapStmt struct {
+	Stmt
+}
+
+func (s *unwrapStmt) Unwrap() Stmt {
+	return s.Stmt
+}
+
+func TestQueryString(t *testing.T) {
+	base := &BaseStmt{query: "SELECT 1"}
+	if query := QueryString(&unwrapStmt{&unwrapStmt{base}}); query != "SELECT 1" {
+		t.Fatalf("expected the query of the base statement, got %q", query)
+	}
+	if query := QueryString(&unwrapStmt{}); query != "" {
+		t.Fatalf("expected no query, got %q", query)
+	}
+}